@@ -55,6 +55,7 @@ func StartServer(unstable, enableCrypt bool, port string) {
 		HandshakeTimeout:   time.Second * 5,
 		RewriterBufferSize: 1024,
 		ReconnWaitTimeout:  time.Minute * 5,
+		LegacyHandshake:    true,
 	}
 
 	listener, err := snet.Listen(config, func() (net.Listener, error) {
@@ -0,0 +1,64 @@
+package snet
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// 只有记录层的连接才能发送确认
+func (c *Conn) startAck() {
+	if c.ackInterval > 0 && c.writeRecord != nil {
+		go c.ackLoop()
+	}
+}
+
+func (c *Conn) ackLoop() {
+	ticker := time.NewTicker(c.ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.ack()
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+// 上次确认后收到过新数据才发送
+func (c *Conn) ack() {
+	c.reconnMutex.RLock()
+	defer c.reconnMutex.RUnlock()
+
+	if c.recvCount.Load() > c.ackSent.Load() {
+		c.trace("send ack")
+		c.sendControl(controlAck)
+	}
+}
+
+// Read 收到记录后更新需要确认的字节数，未确认的部分达到 AckBytes 时立即确认
+func (c *Conn) received() {
+	c.recvCount.Store(c.readCount)
+	if c.ackBytes > 0 && c.readCount-c.ackSent.Load() >= uint64(c.ackBytes) {
+		c.trace("send ack")
+		c.sendControl(controlAck)
+	}
+}
+
+// 超出已发送字节数的部分在使用时忽略
+func (c *Conn) handleAck(payload []byte) error {
+	if len(payload) != 8 {
+		return ErrBadRecord
+	}
+	c.trace("recv ack")
+	c.acked(binary.LittleEndian.Uint64(payload))
+	return nil
+}
+
+// 重连时对方发来的已接收字节数同样是确认，唤醒等待确认的 Write
+func (c *Conn) acked(n uint64) {
+	if n > c.peerAcked.Load() {
+		c.peerAcked.Store(n)
+		c.notifyAck()
+	}
+}
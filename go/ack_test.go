@@ -0,0 +1,152 @@
+package snet
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func (c *Conn) ackStateForTest() (unacked uint64, buffered int) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.unacked(), c.rewriter.Buffered()
+}
+
+// 固定长度的随机数据，RandBytes 的长度是随机的
+func randBlock(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func waitAcked(t *testing.T, c *Conn) {
+	for i := 0; ; i++ {
+		if unacked, _ := c.ackStateForTest(); unacked == 0 {
+			return
+		}
+		if i == 200 {
+			t.Fatalf("data not acked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Ack_Trim(t *testing.T) {
+	srvConfig := Config{
+		RewriterBufferSize: 64 * 1024,
+		ReconnWaitTimeout:  time.Minute,
+		AckBytes:           4096,
+		AckInterval:        10 * time.Millisecond,
+	}
+	cliConfig := srvConfig
+
+	listener, conn, sconn := testConns(t, srvConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+	go io.Copy(io.Discard, sconn)
+
+	// 确认记录由 Read 处理
+	go io.Copy(io.Discard, conn)
+
+	for i := 0; i < 50; i++ {
+		if _, err := conn.Write(randBlock(1000)); err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+	}
+
+	waitAcked(t, conn)
+	conn.Write([]byte("x"))
+	if _, buffered := conn.ackStateForTest(); buffered > 1+recordHeaderSize+conn.writeRecord.overhead() {
+		t.Fatalf("acked data not released, buffered = %d", buffered)
+	}
+}
+
+func Test_Ack_Reconn(t *testing.T) {
+	config := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 8 * 1024,
+		ReconnWaitTimeout:  time.Minute,
+		AckBytes:           1024,
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+	go io.Copy(sconn, sconn)
+
+	for i := 0; i < 100; i++ {
+		if i%10 == 5 {
+			conn.baseForTest().Close()
+		}
+
+		b := RandBytes(100 + rand.Intn(2000))
+		if _, err := conn.Write(b); err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+		c := make([]byte, len(b))
+		if _, err := io.ReadFull(conn, c); err != nil {
+			t.Fatalf("read failed: %s", err)
+		}
+		if !bytes.Equal(b, c) {
+			t.Fatalf("b != c")
+		}
+	}
+}
+
+func Test_Ack_Overflow(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	srvConfig := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		AckBytes:           1,
+	}
+	cliConfig := srvConfig
+	cliConfig.Metrics = metrics
+
+	listener, conn, sconn := testConns(t, srvConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	go io.Copy(io.Discard, conn)
+
+	// 对方确认后不再读取
+	conn.Write([]byte("hello"))
+	go func() {
+		var buf [5]byte
+		io.ReadFull(sconn, buf[:])
+	}()
+	waitAcked(t, conn)
+
+	for i := 0; i < 10; i++ {
+		conn.Write(randBlock(500))
+	}
+	if n := metrics.Snapshot().RewriterOverflows; n != 1 {
+		t.Fatalf("RewriterOverflows = %d", n)
+	}
+}
+
+func Test_Ack_Disabled(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	config := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		Metrics:            metrics,
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+	go io.Copy(io.Discard, sconn)
+
+	for i := 0; i < 10; i++ {
+		conn.Write(randBlock(500))
+	}
+	if unacked, _ := conn.ackStateForTest(); unacked == 0 {
+		t.Fatalf("unexpected ack")
+	}
+	if n := metrics.Snapshot().RewriterOverflows; n != 0 {
+		t.Fatalf("RewriterOverflows = %d", n)
+	}
+}
@@ -0,0 +1,181 @@
+package snet
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+var ErrBackpressure = newError("snet: unacknowledged data would exceed the rewriter buffer", false)
+
+// Backpressure 未确认的数据将要超出重传缓冲区时 Write 的行为
+type Backpressure int
+
+const (
+	// 覆盖最早的数据
+	BackpressureNone Backpressure = iota
+
+	// 等待对方确认，受写超时限制，超过一条记录的数据分段写入，超时返回时可能只写入了一部分
+	BackpressureBlock
+
+	// 不写入任何数据，返回 ErrBackpressure，一次写入的数据超出缓冲区时总是返回错误
+	BackpressureError
+)
+
+// 为 Write 时一起发送的控制记录预留的空间
+func (c *Conn) controlReserve() int {
+	return 3*(recordHeaderSize+c.writeRecord.overhead()) + len(c.ackBuf)
+}
+
+// n 个字节的数据切分成记录后的大小
+func (c *Conn) sealedSize(n int) int {
+	records := max((n+maxRecordPayload-1)/maxRecordPayload, 1)
+	return n + records*(recordHeaderSize+c.writeRecord.overhead())
+}
+
+// 丢弃对方已确认的数据并按需扩容，返回不覆盖未确认数据时还能放入的字节数
+func (c *Conn) rewriterRoom(need int) int {
+	c.rewriter.trim(c.unacked())
+	c.rewriter.grow(need)
+	return c.rewriter.capacity() - c.rewriter.Buffered()
+}
+
+// 调用者需持有 writeMutex 和 reconnMutex 的读锁
+func (c *Conn) writeBackpressure(b []byte) (n int, err error) {
+	reserve := c.controlReserve()
+
+	if c.backpressure == BackpressureError {
+		need := c.sealedSize(len(b)) + reserve
+		if c.rewriterRoom(need) < need {
+			return 0, ErrBackpressure
+		}
+		return c.write(b)
+	}
+
+	for n < len(b) {
+		size := min(len(b)-n, maxRecordPayload)
+		room := c.rewriterRoom(c.sealedSize(size)+reserve) - reserve - c.sealedSize(0)
+		if room <= 0 {
+			// 缓冲区全空也放不下时等待不会有结果
+			if c.unacked() == 0 {
+				return n, ErrBackpressure
+			}
+			if err = c.waitAck(); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		m, err := c.write(b[n : n+min(size, room)])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// 收到确认、重连成功或 Read 留下了控制记录时唤醒等待中的 Write
+func (c *Conn) notifyAck() {
+	select {
+	case c.ackChan <- struct{}{}:
+	default:
+	}
+}
+
+// 应用层没有在 Read 时 waitAck 每次读取确认的最长时间，期间开始的 Read 最多等待这么久
+const ackPollInterval = 100 * time.Millisecond
+
+// 等待对方确认，期间释放 reconnMutex 让重连可以进行，writeMutex 保持锁定以保证数据的顺序，
+// Read 留下的控制记录由这里代为发送。应用层只写不读时由这里读取对方发来的确认。
+// 超时或连接关闭时不再重新获取 reconnMutex，由 unlockReconn 跳过解锁
+func (c *Conn) waitAck() (err error) {
+	c.trace("waitAck()")
+
+	deadlineTimer := time.NewTimer(time.Hour)
+	defer deadlineTimer.Stop()
+	pollTimer := time.NewTimer(ackPollInterval)
+	defer pollTimer.Stop()
+
+	c.reconnMutex.RUnlock()
+	defer func() {
+		if err != nil {
+			c.writeUnlocked = true
+			return
+		}
+		c.reconnMutex.RLock()
+		c.flushControl()
+	}()
+
+WAIT:
+	deadlineTimer.Stop()
+	d := c.writeDeadline.Load()
+	if d != 0 {
+		deadlineTimer.Reset(time.Until(time.Unix(0, d)))
+	}
+
+	if c.readMutex.TryLock() {
+		until := time.Now().Add(ackPollInterval)
+		if d != 0 && d < until.UnixNano() {
+			until = time.Unix(0, d)
+		}
+		if c.pumpAck(until) {
+			select {
+			case <-c.ackChan:
+				return nil
+			case <-c.closeChan:
+				return c.closeError(net.ErrClosed)
+			default:
+			}
+			if deadlinePassed(&c.writeDeadline) {
+				c.trace("waitAck() deadline exceeded")
+				return os.ErrDeadlineExceeded
+			}
+			goto WAIT
+		}
+	}
+
+	// Read 正在进行或有数据等待 Read 取走时由 Read 处理确认，Read 结束后重新检查
+	pollTimer.Reset(ackPollInterval)
+	select {
+	case <-c.ackChan:
+		return nil
+	case <-deadlineTimer.C:
+		if d := c.writeDeadline.Load(); d == 0 || time.Now().UnixNano() < d {
+			goto WAIT
+		}
+		c.trace("waitAck() deadline exceeded")
+		return os.ErrDeadlineExceeded
+	case <-c.writeDeadlineChan:
+		goto WAIT
+	case <-pollTimer.C:
+		goto WAIT
+	case <-c.closeChan:
+		c.trace("waitAck() closed")
+		return c.closeError(net.ErrClosed)
+	}
+}
+
+// 代替 Read 读取记录直到 until，处理其中的确认和心跳，读到数据记录时留给 Read。
+// 调用者需持有 readMutex，返回时已经释放；没有读取时返回 false
+func (c *Conn) pumpAck(until time.Time) bool {
+	defer c.readMutex.Unlock()
+	c.reconnMutex.RLock()
+	defer c.unlockReconn(&c.readUnlocked)
+
+	if c.readRecord == nil || len(c.readPlain) > 0 || c.closed {
+		return false
+	}
+
+	c.trace("pumpAck()")
+	c.base.SetReadDeadline(until)
+	_, err := c.readRecords(nil)
+	if !c.readUnlocked {
+		c.base.SetReadDeadline(loadDeadline(&c.readDeadline))
+	}
+	if err == ErrBadRecord {
+		c.trace("bad record")
+		c.closeWithError(ErrBadRecord)
+	}
+	return true
+}
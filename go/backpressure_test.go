@@ -0,0 +1,194 @@
+package snet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+var backpressureConfig = Config{
+	EnableCrypt:        true,
+	RewriterBufferSize: 4096,
+	ReconnWaitTimeout:  time.Minute,
+	AckBytes:           1,
+}
+
+func Test_Backpressure_Block(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	cliConfig := backpressureConfig
+	cliConfig.Backpressure = BackpressureBlock
+	cliConfig.Metrics = metrics
+	listener, conn, sconn := testConns(t, backpressureConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	b := randBlock(64 * 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(b)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("write not blocked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c := make([]byte, len(b))
+	if _, err := io.ReadFull(sconn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Fatalf("b != c")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	if n := metrics.Snapshot().RewriterOverflows; n != 0 {
+		t.Fatalf("RewriterOverflows = %d", n)
+	}
+}
+
+func Test_Backpressure_Deadline(t *testing.T) {
+	cliConfig := backpressureConfig
+	cliConfig.Backpressure = BackpressureBlock
+	listener, conn, sconn := testConns(t, backpressureConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	b := randBlock(64 * 1024)
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := conn.Write(b)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if n == 0 || n == len(b) {
+		t.Fatalf("n = %d", n)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+	go conn.Write(b[n:])
+
+	c := make([]byte, len(b))
+	if _, err := io.ReadFull(sconn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Fatalf("b != c")
+	}
+}
+
+func Test_Backpressure_Error(t *testing.T) {
+	cliConfig := backpressureConfig
+	cliConfig.Backpressure = BackpressureError
+	listener, conn, sconn := testConns(t, backpressureConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	var written []byte
+	for {
+		b := randBlock(1000)
+		n, err := conn.Write(b)
+		if err == ErrBackpressure {
+			if n != 0 {
+				t.Fatalf("n = %d", n)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+		written = append(written, b...)
+	}
+	if len(written) == 0 || len(written) > 4096 {
+		t.Fatalf("written = %d", len(written))
+	}
+
+	c := make([]byte, len(written))
+	if _, err := io.ReadFull(sconn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(written, c) {
+		t.Fatalf("written != c")
+	}
+
+	for i := 0; ; i++ {
+		_, err := conn.Write([]byte("hello"))
+		if err == nil {
+			break
+		}
+		if err != ErrBackpressure || i == 200 {
+			t.Fatalf("write failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := conn.Write(randBlock(8192)); err != ErrBackpressure {
+		t.Fatalf("oversized write: %v", err)
+	}
+}
+
+func Test_Backpressure_Reconn(t *testing.T) {
+	cliConfig := backpressureConfig
+	cliConfig.Backpressure = BackpressureBlock
+	listener, conn, sconn := testConns(t, backpressureConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	b := randBlock(64 * 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(b)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	conn.baseForTest().Close()
+
+	c := make([]byte, len(b))
+	if _, err := io.ReadFull(sconn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Fatalf("b != c")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+}
+
+func Test_Backpressure_WriteOnly(t *testing.T) {
+	srvConfig := backpressureConfig
+	srvConfig.Backpressure = BackpressureBlock
+	listener, conn, sconn := testConns(t, srvConfig, backpressureConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 服务端只写不读，确认由 Write 自己读取
+	b := randBlock(64 * 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := sconn.Write(b)
+		done <- err
+	}()
+
+	c := make([]byte, len(b))
+	if _, err := io.ReadFull(conn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Fatalf("b != c")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write blocked")
+	}
+}
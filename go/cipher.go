@@ -0,0 +1,140 @@
+package snet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rc4"
+	"crypto/sha256"
+)
+
+const (
+	SUITE_NONE       byte = 0x00
+	SUITE_RC4        byte = 0x01
+	SUITE_AES128_CTR byte = 0x02
+	SUITE_AES256_CTR byte = 0x03
+	SUITE_AES128_GCM byte = 0x04
+	SUITE_AES256_GCM byte = 0x05
+)
+
+// Cipher 流式加密器，与 crypto/cipher.Stream 兼容
+type Cipher interface {
+	XORKeyStream(dst, src []byte)
+}
+
+// CipherSuite 可在握手阶段协商的加密套件，需要实现 StreamSuite 或 AEADSuite。
+// ID 在握手中标识套件，通讯双方需对同一个 ID 使用相同的算法；
+// 收到的 key 长度为 KeySize，由握手协商出的密钥按收发方向分别派生。
+type CipherSuite interface {
+	ID() byte
+	KeySize() int
+}
+
+// StreamSuite 流式加密套件，只加密不校验
+type StreamSuite interface {
+	CipherSuite
+	NewCipher(key []byte) (Cipher, error)
+}
+
+// AEADSuite 带认证的加密套件，数据被切分成记录，每条记录都带有校验标签，
+// 记录被篡改时 Read 返回 ErrBadRecord 并关闭连接
+type AEADSuite interface {
+	CipherSuite
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	NoneSuite      StreamSuite = noneSuite{}
+	RC4Suite       StreamSuite = rc4Suite{}
+	AES128CTRSuite StreamSuite = aesCTRSuite{SUITE_AES128_CTR, 16}
+	AES256CTRSuite StreamSuite = aesCTRSuite{SUITE_AES256_CTR, 32}
+	AES128GCMSuite AEADSuite   = aesGCMSuite{SUITE_AES128_GCM, 16}
+	AES256GCMSuite AEADSuite   = aesGCMSuite{SUITE_AES256_GCM, 32}
+)
+
+type noneSuite struct{}
+
+func (noneSuite) ID() byte     { return SUITE_NONE }
+func (noneSuite) KeySize() int { return 0 }
+
+func (noneSuite) NewCipher(key []byte) (Cipher, error) {
+	return noneCipher{}, nil
+}
+
+type noneCipher struct{}
+
+func (noneCipher) XORKeyStream(dst, src []byte) {
+	copy(dst, src)
+}
+
+type rc4Suite struct{}
+
+func (rc4Suite) ID() byte     { return SUITE_RC4 }
+func (rc4Suite) KeySize() int { return 16 }
+
+func (rc4Suite) NewCipher(key []byte) (Cipher, error) {
+	return rc4.NewCipher(key)
+}
+
+type aesCTRSuite struct {
+	id      byte
+	keySize int
+}
+
+func (s aesCTRSuite) ID() byte { return s.id }
+
+// 密钥之后紧跟 aes.BlockSize 字节的初始向量
+func (s aesCTRSuite) KeySize() int { return s.keySize + aes.BlockSize }
+
+func (s aesCTRSuite) NewCipher(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key[:s.keySize])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, key[s.keySize:]), nil
+}
+
+type aesGCMSuite struct {
+	id      byte
+	keySize int
+}
+
+func (s aesGCMSuite) ID() byte     { return s.id }
+func (s aesGCMSuite) KeySize() int { return s.keySize }
+
+func (s aesGCMSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func findSuite(suites []CipherSuite, id byte) CipherSuite {
+	for _, suite := range suites {
+		if suite.ID() == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+// 两个方向使用不同的密钥，避免同一密钥流被重复使用
+func deriveKey(secret, salt []byte, info string, size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return hkdf.Key(sha256.New, secret, salt, info, size)
+}
+
+// 新版握手中连接ID与派生出的掩码异或后传输，不占用加密器的密钥流
+func cryptConnID(b, secret, salt []byte) error {
+	mask, err := deriveKey(secret, salt, "snet conn id", len(b))
+	if err != nil {
+		return err
+	}
+	for i := range b {
+		b[i] ^= mask[i]
+	}
+	return nil
+}
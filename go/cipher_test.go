@@ -0,0 +1,52 @@
+package snet
+
+import (
+	"testing"
+	"time"
+)
+
+func suitesConfig(suites ...CipherSuite) Config {
+	return Config{
+		HandshakeTimeout:   time.Second * 5,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute * 5,
+		CipherSuites:       suites,
+	}
+}
+
+func Test_Suite_None(t *testing.T) {
+	config := suitesConfig(NoneSuite)
+	ConfigConnTest(t, config, config, true, true)
+}
+
+func Test_Suite_RC4(t *testing.T) {
+	config := suitesConfig(RC4Suite)
+	ConfigConnTest(t, config, config, true, true)
+}
+
+func Test_Suite_AES128CTR(t *testing.T) {
+	config := suitesConfig(AES128CTRSuite)
+	ConfigConnTest(t, config, config, true, true)
+}
+
+func Test_Suite_AES256CTR(t *testing.T) {
+	config := suitesConfig(AES256CTRSuite)
+	ConfigConnTest(t, config, config, true, true)
+}
+
+func Test_Suite_Negotiate(t *testing.T) {
+	ConfigConnTest(t,
+		suitesConfig(AES256CTRSuite, AES128CTRSuite, RC4Suite),
+		suitesConfig(RC4Suite, AES128CTRSuite),
+		false, true,
+	)
+}
+
+func Test_Suite_Mismatch(t *testing.T) {
+	listener := testListen(t, suitesConfig(AES128CTRSuite))
+	defer listener.Close()
+
+	if _, err := testDial(listener, suitesConfig(RC4Suite)); err == nil {
+		t.Fatalf("dial should fail without common cipher suite")
+	}
+}
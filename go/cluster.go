@@ -0,0 +1,159 @@
+package snet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var errRedirected = errors.New("snet: reconnect redirected")
+
+// 连接ID的高 16 位为创建会话的节点ID，低 48 位随机生成
+const (
+	nodeIDShift = 48
+	connIDMask  = 1<<nodeIDShift - 1
+)
+
+// NodeOf 返回创建会话的节点ID
+func NodeOf(connID uint64) uint16 {
+	return uint16(connID >> nodeIDShift)
+}
+
+// SessionLocator 集群部署时查找会话所在的节点。
+// 重连请求中的会话不在本节点时，Listener 把重连转发到会话所在的节点，
+// 或者在 Config.RedirectReconnect 开启时让客户端直接重连到该节点
+type SessionLocator interface {
+	// 返回会话所在节点的地址，找不到时返回 false
+	Locate(connID uint64) (addr string, ok bool)
+
+	// 转发重连时连接其它节点
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// StaticLocator 按连接ID中的节点ID查找节点地址，通过 TCP 转发
+type StaticLocator map[uint16]string
+
+func (s StaticLocator) Locate(connID uint64) (string, bool) {
+	addr, ok := s[NodeOf(connID)]
+	return addr, ok
+}
+
+func (s StaticLocator) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// 随机生成的连接ID无法从其它会话的ID推算出来，也不会暴露连接数，进程重启后不会按顺序重复使用。
+// 为 0 或与本节点现有的会话冲突时重新生成
+func (l *Listener) newConnID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		id := binary.LittleEndian.Uint64(b[:]) & connIDMask
+		if id == 0 {
+			continue
+		}
+		id |= uint64(l.config.NodeID) << nodeIDShift
+		if _, exists := l.getConn(id); !exists {
+			return id
+		}
+	}
+}
+
+// 会话不在本节点时按 SessionLocator 转发或重定向，返回 false 时按会话不存在处理。
+// 本节点创建的会话不再查找，避免转发给自己
+func (l *Listener) routeReconn(conn net.Conn, reconnType byte, req []byte) bool {
+	locator := l.config.SessionLocator
+	connID := binary.LittleEndian.Uint64(req)
+	if locator == nil || NodeOf(connID) == l.config.NodeID {
+		return false
+	}
+
+	addr, ok := locator.Locate(connID)
+	if !ok {
+		return false
+	}
+
+	// 旧版重连请求的响应没有状态码，只能转发
+	if l.config.RedirectReconnect && reconnType != TYPE_RECONN && len(addr) <= 255 {
+		l.redirectReconn(conn, addr)
+	} else {
+		l.forwardReconn(conn, reconnType, req, addr)
+	}
+	return true
+}
+
+// 状态码为 RECONN_SESSION_MIGRATED 时，24 个字节的响应后跟 1 个字节的地址长度和节点地址
+func (l *Listener) redirectReconn(conn net.Conn, addr string) {
+	l.log(slog.LevelInfo, "reconnect redirected", "remote_addr", conn.RemoteAddr().String(), "node_addr", addr)
+	l.config.metrics().ReconnectRefused(refuseReason(RECONN_SESSION_MIGRATED))
+
+	var buf [24]byte
+	resp := append(buf[:], byte(len(addr)))
+	resp = append(resp, addr...)
+	writeReconnResponse(conn, TYPE_RECONN2, RECONN_SESSION_MIGRATED, resp)
+	conn.Close()
+}
+
+// 把重连请求原样转发给会话所在的节点，之后双向复制数据直到一方断开。
+// 验证在会话所在的节点上进行，本节点不需要会话的密钥
+func (l *Listener) forwardReconn(conn net.Conn, reconnType byte, req []byte, addr string) {
+	ctx := context.Background()
+	if l.config.ReconnWaitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.config.ReconnWaitTimeout)
+		defer cancel()
+	}
+
+	upstream, err := l.config.SessionLocator.Dial(ctx, addr)
+	if err != nil {
+		l.log(slog.LevelWarn, "forward reconnect failed", "node_addr", addr, "err", err)
+		conn.Close()
+		return
+	}
+
+	if _, err := upstream.Write(append([]byte{reconnType}, req...)); err != nil {
+		l.log(slog.LevelWarn, "forward reconnect failed", "node_addr", addr, "err", err)
+		upstream.Close()
+		conn.Close()
+		return
+	}
+
+	l.log(slog.LevelInfo, "reconnect forwarded", "remote_addr", conn.RemoteAddr().String(), "node_addr", addr)
+	conn.SetDeadline(time.Time{})
+	go splice(conn, upstream)
+}
+
+// 双向复制数据，一方断开时关闭两个连接
+func splice(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	io.Copy(b, a)
+	once.Do(closeBoth)
+}
+
+// 读取重定向响应中的节点地址
+func readRedirect(conn net.Conn) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return "", err
+	}
+	addr := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
@@ -0,0 +1,190 @@
+package snet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 在同一个进程中启动多个节点，共享一个 StaticLocator
+type testCluster struct {
+	t         *testing.T
+	locator   StaticLocator
+	listeners []*Listener
+}
+
+func newTestCluster(t *testing.T, nodes int, config Config) *testCluster {
+	c := &testCluster{t: t, locator: StaticLocator{}}
+	for i := 1; i <= nodes; i++ {
+		config.NodeID = uint16(i)
+		config.SessionLocator = c.locator
+		l, err := Listen(config, func() (net.Listener, error) {
+			return net.Listen("tcp", "127.0.0.1:0")
+		})
+		if err != nil {
+			t.Fatalf("listen failed: %s", err)
+		}
+		c.locator[uint16(i)] = l.Addr().String()
+		c.listeners = append(c.listeners, l)
+	}
+	return c
+}
+
+func (c *testCluster) Close() {
+	for _, l := range c.listeners {
+		l.Close()
+	}
+}
+
+func (c *testCluster) node(id uint16) *Listener {
+	return c.listeners[id-1]
+}
+
+// 客户端的拨号目标可以随时切换，模拟负载均衡把重连分配到其它节点
+func (c *testCluster) dial(config Config, node uint16) (*Conn, *atomic.Value) {
+	var target atomic.Value
+	target.Store(c.node(node).Addr().String())
+	config.ReconnectPolicy.InitialBackoff = 10 * time.Millisecond
+	conn, err := Dial(config, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Load().(string))
+	})
+	if err != nil {
+		c.t.Fatalf("dial failed: %s", err)
+	}
+	return conn.(*Conn), &target
+}
+
+func (c *testCluster) accept(node uint16) *Conn {
+	sconn, err := c.node(node).Accept()
+	if err != nil {
+		c.t.Fatalf("accept failed: %s", err)
+	}
+	return sconn.(*Conn)
+}
+
+func echoCheck(t *testing.T, conn net.Conn) {
+	b := randBlock(256)
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	c := make([]byte, len(b))
+	if _, err := io.ReadFull(conn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Fatalf("b != c")
+	}
+}
+
+func Test_Cluster_ConnID(t *testing.T) {
+	cluster := newTestCluster(t, 3, Config{EnableCrypt: true})
+	defer cluster.Close()
+
+	for node := uint16(1); node <= 3; node++ {
+		conn, _ := cluster.dial(Config{EnableCrypt: true}, node)
+		sconn := cluster.accept(node)
+		if NodeOf(conn.id) != node || sconn.id != conn.id {
+			t.Fatalf("conn id = %x, node = %d", conn.id, node)
+		}
+		conn.Close()
+	}
+}
+
+func Test_Cluster_Forward(t *testing.T) {
+	for _, config := range []Config{
+		{EnableCrypt: true},
+		{EnableCrypt: true, LegacyHandshake: true},
+	} {
+		config.RewriterBufferSize = 1024
+		config.ReconnWaitTimeout = time.Minute
+		testClusterReconn(t, config, false)
+	}
+}
+
+func Test_Cluster_Redirect(t *testing.T) {
+	config := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		RedirectReconnect:  true,
+	}
+	testClusterReconn(t, config, true)
+}
+
+func testClusterReconn(t *testing.T, config Config, redirect bool) {
+	cluster := newTestCluster(t, 3, config)
+	defer cluster.Close()
+
+	var redirected atomic.Value
+	cliConfig := config
+	cliConfig.RedirectDialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		redirected.Store(addr)
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	conn, target := cluster.dial(cliConfig, 1)
+	defer conn.Close()
+	sconn := cluster.accept(1)
+	go io.Copy(sconn, sconn)
+	echoCheck(t, conn)
+
+	// 重连被分配到节点 2，由节点 2 转发或重定向回节点 1
+	target.Store(cluster.node(2).Addr().String())
+	conn.baseForTest().Close()
+	echoCheck(t, conn)
+
+	addr, _ := redirected.Load().(string)
+	if redirect && addr != cluster.node(1).Addr().String() {
+		t.Fatalf("redirected to %q", addr)
+	}
+	if !redirect && addr != "" {
+		t.Fatalf("unexpected redirect to %q", addr)
+	}
+
+	// 再断开一次，转发的连接也能正常重连
+	conn.baseForTest().Close()
+	echoCheck(t, conn)
+}
+
+func Test_Cluster_RedirectRefused(t *testing.T) {
+	config := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		RedirectReconnect:  true,
+	}
+	cluster := newTestCluster(t, 2, config)
+	defer cluster.Close()
+
+	conn, target := cluster.dial(config, 1)
+	defer conn.Close()
+	cluster.accept(1)
+
+	// 客户端没有设置 RedirectDialer 时按拒绝重连处理
+	target.Store(cluster.node(2).Addr().String())
+	conn.baseForTest().Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrSessionMigrated) {
+		t.Fatalf("err = %v, want ErrSessionMigrated", err)
+	}
+}
+
+func Test_Cluster_RandomConnID(t *testing.T) {
+	l := &Listener{config: Config{NodeID: 7}, conns: make(map[uint64]*Conn)}
+	var last uint64
+	for i := 0; i < 1000; i++ {
+		id := l.newConnID()
+		if NodeOf(id) != 7 || id&connIDMask == 0 {
+			t.Fatalf("conn id = %x", id)
+		}
+		if _, exists := l.conns[id]; exists || id == last+1 {
+			t.Fatalf("conn id = %x, last = %x", id, last)
+		}
+		l.conns[id] = nil
+		last = id
+	}
+}
@@ -2,13 +2,21 @@ package snet
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rc4"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	dh64 "github.com/funny/crypto/dh64/go"
@@ -16,53 +24,290 @@ import (
 
 var _ net.Conn = &Conn{}
 
+var (
+	ErrNoCipherSuite = subError("snet: no cipher suite in common", ErrHandshakeFailed)
+
+	errRetransmit   = errors.New("snet: retransmission failed")
+	errTryLater     = errors.New("snet: reconnect rate limited by server")
+	errBaseReplaced = errors.New("snet: base conn replaced by reconnect")
+)
+
 type Config struct {
-	EnableCrypt        bool
-	HandshakeTimeout   time.Duration
-	RewriterBufferSize int
-	ReconnWaitTimeout  time.Duration
+	EnableCrypt      bool
+	HandshakeTimeout time.Duration
+
+	// 服务端同时进行的新建连接握手数量上限，还没有发送请求类型的连接也计入，超出时直接关闭新的连接，
+	// 重连在收到请求类型后不再计入；为 0 时不限制，限制时 HandshakeTimeout 为 0 则为 10 秒
+	MaxHandshakes int
+
+	// 每个来源 IP 每秒允许建立的 TCP 连接数（包括重连）和突发次数，超出时不读取任何数据直接关闭连接。
+	// HandshakeRate 为 0 时不限制，HandshakeBurst 为 0 时为 HandshakeRate 取整
+	HandshakeRate  float64
+	HandshakeBurst int
+
+	// 等待 Accept 取走的会话数量上限，排满时新的握手被拒绝，为 0 时为 1000
+	AcceptBacklog int
+
+	// 服务端会话的重连验证连续失败 MaxReconnectFailures 次后，ReconnectLockout 时间内拒绝该会话的重连。
+	// MaxReconnectFailures 为 0 时不限制，ReconnectLockout 为 0 时为 10 秒
+	MaxReconnectFailures int
+	ReconnectLockout     time.Duration
+
+	// 每个来源 IP 每秒允许的重连请求次数和突发次数，超出时让客户端稍后再试。
+	// ReconnectRate 为 0 时不限制，ReconnectBurst 为 0 时为 ReconnectRate 取整
+	ReconnectRate  float64
+	ReconnectBurst int
+
+	// 重传缓冲区的初始大小，需要重传的数据超出缓冲区时无法重连。
+	// 写入的数据放不下时缓冲区可以扩容到 RewriterMaxSize，连接超过 RewriterIdleTimeout 没有写入时缩回初始大小，
+	// 断线期间不缩小，也不会缩掉对方未确认的数据（没有开启确认时为缓冲区中的全部数据），
+	// 同一个 Listener 上所有连接扩容的部分加起来不超过 RewriterBudget。
+	// RewriterMaxSize 不大于 RewriterBufferSize 时不扩容，RewriterBudget 为 0 时不限制，RewriterIdleTimeout 为 0 时为 1 分钟
+	RewriterBufferSize  int
+	RewriterMaxSize     int
+	RewriterBudget      int64
+	RewriterIdleTimeout time.Duration
+
+	// 重传缓冲区放不下的数据移入 SpoolDir 下的临时文件，文件中最多保留 SpoolMaxSize 字节，连接关闭时删除。
+	// SpoolMaxSize 为 0 时不使用文件，SpoolDir 为空时使用系统的临时目录
+	SpoolDir     string
+	SpoolMaxSize int64
+
+	// 断线后等待重连的时间，服务端会话超时未重连时被关闭回收，即使应用层没有在 Read 或 Write 中等待。
+	// 断线只能在 Read、Write 或发送心跳失败时发现，应用层不读写时需要开启 HeartbeatInterval，
+	// 并且只能发现对方已经关闭的连接，对方无声消失时要等到 TCP 放弃重传；旧版握手的连接不支持心跳
+	ReconnWaitTimeout time.Duration
+
+	// 按优先级排列的加密套件，在 TYPE_NEWCONN2 握手中协商；
+	// 为空时由 EnableCrypt 决定使用 AES 加密还是不加密
+	CipherSuites []CipherSuite
+
+	// 按优先级排列的验证算法版本，服务端只接受列表中的版本，为空时为 HMAC-SHA256 和 MD5。
+	// 旧版握手只支持 MD5，所有客户端升级后可以去掉 PROOF_MD5
+	Proofs []byte
+
+	// 客户端的重连策略
+	ReconnectPolicy ReconnectPolicy
+
+	// 集群部署时服务端的节点ID，保存在连接ID的高 16 位。
+	// 会话不在本节点时通过 SessionLocator 转发重连，RedirectReconnect 开启时改为让客户端重连到会话所在的节点
+	NodeID            uint16
+	SessionLocator    SessionLocator
+	RedirectReconnect bool
+
+	// 集群中其它节点的 IP，转发过来的连接已经在收到客户端的节点上限制过频率，
+	// 不再受 HandshakeRate 和 ReconnectRate 限制
+	TrustedPeers []string
+
+	// 客户端收到重定向时用来连接会话所在的节点，为空时按拒绝重连处理
+	RedirectDialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// 客户端后台重连使用的 context，结束时停止重连并关闭连接，为空时不限制
+	ReconnectContext context.Context
+
+	// 连接空闲超过 HeartbeatInterval 时发送心跳，对方在 Read 中收到后回应；
+	// Read 等待超过 HeartbeatTimeout 仍没有收到任何数据时断开底层连接并重连。
+	// HeartbeatTimeout 为 0 时为 HeartbeatInterval 的 3 倍，旧版握手的连接不支持心跳
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// 每收到 AckBytes 字节或每隔 AckInterval 向对方确认已接收的字节数，对方据此释放重传缓冲区中已确认的数据，
+	// 未确认的数据超出缓冲区时也能在断线前发现。两者都为 0 时不发送确认，旧版握手的连接不支持确认。
+	// 与心跳回应一样，收到的确认在 Read 中处理；Backpressure 为 BackpressureBlock 时等待确认的 Write 也会读取确认，
+	// 此时对方发来的数据要等应用层 Read 取走后才能继续读取后面的确认
+	AckBytes    int
+	AckInterval time.Duration
+
+	// 未确认的数据加上要写入的数据超出重传缓冲区时 Write 的行为，默认覆盖最早的数据，之后断线将无法重连。
+	// 需要对方开启确认，否则缓冲区写满后所有数据都视为未确认，旧版握手的连接不支持
+	Backpressure Backpressure
+
+	// 连接的生命周期回调
+	Hooks Hooks
+
+	// 握手、重连和会话数量的统计，为空时不统计
+	Metrics Metrics
+
+	// 日志输出，为空时不输出
+	Logger Logger
+
+	// 兼容旧版客户端的 8 字节 DH 密钥交换（TYPE_NEWCONN），只支持 RC4 加密，密钥强度仅 64 位。
+	// 服务端开启后同时接受新旧两种握手，客户端开启后使用旧版握手
+	LegacyHandshake bool
+}
+
+func (config *Config) cipherSuites() []CipherSuite {
+	switch {
+	case len(config.CipherSuites) != 0:
+		return config.CipherSuites
+	case config.EnableCrypt:
+		return []CipherSuite{AES128GCMSuite, AES256GCMSuite, AES128CTRSuite, AES256CTRSuite}
+	}
+	return []CipherSuite{NoneSuite}
 }
 
 type Dialer func() (net.Conn, error)
 
+type ContextDialer func(ctx context.Context) (net.Conn, error)
+
 type Conn struct {
 	base     net.Conn
+	addrs    atomic.Pointer[connAddrs]
 	id       uint64
 	listener *Listener
-	dialer   Dialer
-
-	key         [8]byte
+	dialer   ContextDialer
+
+	key         []byte
+	suite       byte
+	secret      []byte
+	salt        []byte
+	proof       byte
+	legacy      bool
 	enableCrypt bool
 
 	closed    bool
+	closeErr  error
 	closeChan chan struct{}
 	closeOnce sync.Once
 
 	writeMutex  sync.Mutex
-	writeCipher *rc4.Cipher
+	writeCipher Cipher
+	writeRecord *recordCipher
+	writeBuf    []byte
 
 	readMutex  sync.Mutex
-	readCipher *rc4.Cipher
+	readCipher Cipher
+	readRecord *recordCipher
+	readBuf    []byte
+	readPlain  []byte
+	plainBuf   []byte
 
 	reconnMutex       sync.RWMutex
 	reconnOpMutex     sync.Mutex
-	readWaiting       bool
-	writeWaiting      bool
-	readWaitChan      chan struct{}
-	writeWaitChan     chan struct{}
-	reconnWaitTimeout time.Duration
-
-	rewriter   rewriter
-	rereader   rereader
-	readCount  uint64
-	writeCount uint64
+	reconnChan        chan struct{}
+	readUnlocked      bool
+	writeUnlocked     bool
+	reconnWaitTimeout atomic.Int64
+	reconnPolicy      ReconnectPolicy
+	reconnCtx         context.Context
+	redirectDialer    func(ctx context.Context, addr string) (net.Conn, error)
+	redirectAddr      string
+	hooks             Hooks
+	metrics           Metrics
+	logger            Logger
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	reading           atomic.Bool
+	lastRecv          atomic.Int64
+	lastSend          atomic.Int64
+	lostAt            atomic.Int64
+	pending           atomic.Uint32
+
+	// 客户端为最近一次重连请求的序号，服务端为最近一次通过验证的序号
+	reconnSeq      atomic.Uint64
+	reconnFailures atomic.Int32
+	lockedUntil    atomic.Int64
+
+	ackBytes    int
+	ackInterval time.Duration
+	ackBuf      [8]byte
+	recvCount   atomic.Uint64
+	ackSent     atomic.Uint64
+	peerAcked   atomic.Uint64
+	overflowed  bool
+
+	backpressure Backpressure
+	ackChan      chan struct{}
+
+	readDeadline      atomic.Int64
+	writeDeadline     atomic.Int64
+	readDeadlineChan  chan struct{}
+	writeDeadlineChan chan struct{}
+
+	rewriter     rewriter
+	rewriterIdle time.Duration
+	rereader     rereader
+	readCount    uint64
+	writeCount   uint64
 }
 
 func Dial(config Config, dialer Dialer) (net.Conn, error) {
-	conn, err := dialer()
+	return DialContext(context.Background(), config, func(context.Context) (net.Conn, error) {
+		return dialer()
+	})
+}
+
+// DialContext 新建连接，ctx 和 Config.HandshakeTimeout 同时限制拨号和握手的时间，
+// 握手完成后 ctx 不再影响连接，后台重连由 Config.ReconnectContext 控制
+func DialContext(ctx context.Context, config Config, dialer ContextDialer) (net.Conn, error) {
+	if config.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.HandshakeTimeout)
+		defer cancel()
+	}
+
+	conn, err := dialer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, conn)
+	var sconn *Conn
+	if config.LegacyHandshake {
+		sconn, err = dialLegacy(conn, config)
+	} else {
+		sconn, err = dialX25519(conn, config)
+	}
+	fired := !stop()
+	// watchContext 设置的超时可能晚于下面的清除，握手成功也按 ctx 结束处理
+	if err == nil && fired {
+		err = ctx.Err()
+	}
+	config.metrics().Handshake(err == nil)
+
 	if err != nil {
+		conn.Close()
+		if err = contextError(ctx, err, fired); ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", ErrHandshakeFailed, err)
+		}
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+
+	sconn.dialer = dialer
+	sconn.startHeartbeat()
+	sconn.startAck()
+	sconn.startShrink()
+	return sconn, nil
+}
+
+// ctx 有截止时间或 watchContext 已经打断读写时，conn 上的超时由 watchContext 设置，说明 ctx 已经或即将结束；
+// 否则超时来自 dialer 自己设置的 deadline，与 ctx 无关
+func contextError(ctx context.Context, err error, fired bool) error {
+	if _, ok := ctx.Deadline(); (ok || fired) && errors.Is(err, os.ErrDeadlineExceeded) {
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// 在 ctx 结束时打断 conn 上阻塞的读写，调用返回的函数停止监视
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+func dialLegacy(conn net.Conn, config Config) (*Conn, error) {
+	if !config.acceptProof(PROOF_MD5) {
+		return nil, ErrNoProof
+	}
 
 	var (
 		preBuf [1]byte
@@ -89,107 +334,303 @@ func Dial(config Config, dialer Dialer) (net.Conn, error) {
 	srvPubKey := binary.LittleEndian.Uint64(field1)
 	secret := dh64.Secret(privKey, srvPubKey)
 
-	sconn, err := newConn(conn, 0, secret, config)
-	if err != nil {
+	sconn := newConn(conn, 0, legacyKey(secret), config)
+	sconn.proof = PROOF_MD5
+	sconn.legacy = true
+	if err := sconn.useLegacyCipher(); err != nil {
 		return nil, err
 	}
 
-	// 二次握手
-	sconn.trace("twice handshake")
-	var buf2 [md5.Size]byte
-	hash := md5.New()
-	hash.Write(field3)
-	hash.Write(sconn.key[:])
-	copy(buf2[:], hash.Sum(nil))
-	if _, err := conn.Write(buf2[:]); err != nil {
+	if err := sconn.twiceHandshake(field3); err != nil {
 		return nil, err
 	}
 
 	sconn.readCipher.XORKeyStream(field2, field2)
 	sconn.id = binary.LittleEndian.Uint64(field2)
-	sconn.dialer = dialer
 	return sconn, nil
 }
 
-func newConn(base net.Conn, id, secret uint64, config Config) (conn *Conn, err error) {
-	conn = &Conn{
+func dialX25519(conn net.Conn, config Config) (*Conn, error) {
+	suites := config.cipherSuites()
+	proofs := config.proofs()
+	if len(suites) > 255 || len(proofs) > 255 {
+		return nil, errors.New("snet: too many cipher suites or proof versions")
+	}
+
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pubKey := privKey.PublicKey().Bytes()
+
+	preBuf := []byte{TYPE_NEWCONN2, byte(len(suites))}
+	for _, suite := range suites {
+		preBuf = append(preBuf, suite.ID())
+	}
+	preBuf = append(preBuf, byte(len(proofs)))
+	preBuf = append(preBuf, proofs...)
+	preBuf = append(preBuf, pubKey...)
+	if _, err := conn.Write(preBuf); err != nil {
+		return nil, err
+	}
+
+	var (
+		buf    [2 + x25519KeySize + 16]byte
+		field0 = buf[0:2]
+		field1 = buf[2 : 2+x25519KeySize]
+		field2 = buf[2+x25519KeySize : 10+x25519KeySize]
+		field3 = buf[10+x25519KeySize : 18+x25519KeySize]
+	)
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, err
+	}
+
+	suite := findSuite(suites, field0[0])
+	if suite == nil {
+		return nil, ErrNoCipherSuite
+	}
+
+	if bytes.IndexByte(proofs, field0[1]) < 0 {
+		return nil, ErrNoProof
+	}
+
+	srvPubKey, err := ecdh.X25519().NewPublicKey(field1)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := privKey.ECDH(srvPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(pubKey, field1...)
+	sconn := newConn(conn, 0, nil, config)
+	sconn.proof = field0[1]
+	if err := sconn.useSuite(suite, secret, salt, true); err != nil {
+		return nil, err
+	}
+
+	if err := sconn.twiceHandshake(field3); err != nil {
+		return nil, err
+	}
+
+	if err := cryptConnID(field2, secret, salt); err != nil {
+		return nil, err
+	}
+	sconn.id = binary.LittleEndian.Uint64(field2)
+	return sconn, nil
+}
+
+// 二次握手，回应服务端的挑战码
+func (c *Conn) twiceHandshake(challenge []byte) error {
+	c.trace("twice handshake")
+	_, err := c.base.Write(c.makeProof(challenge))
+	return err
+}
+
+func newConn(base net.Conn, id uint64, key []byte, config Config) *Conn {
+	if config.ReconnectContext == nil {
+		config.ReconnectContext = context.Background()
+	}
+
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = config.HeartbeatInterval * 3
+	}
+
+	if config.RewriterIdleTimeout == 0 {
+		config.RewriterIdleTimeout = time.Minute
+	}
+
+	c := &Conn{
 		base:              base,
 		id:                id,
+		key:               key,
 		enableCrypt:       config.EnableCrypt,
-		reconnWaitTimeout: config.ReconnWaitTimeout,
+		reconnPolicy:      config.ReconnectPolicy,
+		reconnCtx:         config.ReconnectContext,
+		redirectDialer:    config.RedirectDialer,
+		hooks:             config.Hooks,
+		metrics:           config.metrics(),
+		logger:            config.Logger,
+		heartbeatInterval: config.HeartbeatInterval,
+		heartbeatTimeout:  config.HeartbeatTimeout,
+		ackBytes:          config.AckBytes,
+		ackInterval:       config.AckInterval,
+		backpressure:      config.Backpressure,
+		ackChan:           make(chan struct{}, 1),
 		closeChan:         make(chan struct{}),
-		readWaitChan:      make(chan struct{}),
-		writeWaitChan:     make(chan struct{}),
-		rewriter: rewriter{
-			data: make([]byte, config.RewriterBufferSize),
-		},
+		reconnChan:        make(chan struct{}),
+		readDeadlineChan:  make(chan struct{}, 1),
+		writeDeadlineChan: make(chan struct{}, 1),
+		rewriter:          newRewriter(config.RewriterBufferSize, config.RewriterMaxSize),
+		rewriterIdle:      config.RewriterIdleTimeout,
 	}
+	now := time.Now().UnixNano()
+	c.rewriter.spool = newSpool(config.SpoolDir, config.SpoolMaxSize)
+	c.reconnWaitTimeout.Store(int64(config.ReconnWaitTimeout))
+	c.storeAddrs(base)
+	c.lastRecv.Store(now)
+	c.lastSend.Store(now)
+	return c
+}
 
-	binary.LittleEndian.PutUint64(conn.key[:], secret)
+func legacyKey(secret uint64) []byte {
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], secret)
+	return key[:]
+}
 
-	conn.writeCipher, err = rc4.NewCipher(conn.key[:])
+// 旧版握手的两个方向都直接用 DH 密钥做 RC4 加密
+func (c *Conn) useLegacyCipher() (err error) {
+	c.writeCipher, err = rc4.NewCipher(c.key)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	c.readCipher, err = rc4.NewCipher(c.key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// 从 X25519 协商出的密钥分别派生验证密钥和两个方向的加密密钥，
+// salt 为双方公钥，保证每次握手派生出的密钥都不相同
+func (c *Conn) useSuite(suite CipherSuite, secret, salt []byte, isClient bool) (err error) {
+	readInfo, writeInfo := "snet c2s", "snet s2c"
+	if isClient {
+		readInfo, writeInfo = writeInfo, readInfo
+	}
+
+	if c.key, err = deriveKey(secret, salt, "snet auth", sha256.Size); err != nil {
+		return err
+	}
+
+	readKey, err := deriveKey(secret, salt, readInfo, suite.KeySize())
+	if err != nil {
+		return err
+	}
+
+	writeKey, err := deriveKey(secret, salt, writeInfo, suite.KeySize())
+	if err != nil {
+		return err
+	}
+
+	// 保存会话时需要重新派生密钥
+	c.suite, c.secret, c.salt = suite.ID(), secret, salt
+
+	switch suite := suite.(type) {
+	case StreamSuite:
+		readCipher, err := suite.NewCipher(readKey)
+		if err != nil {
+			return err
+		}
+		writeCipher, err := suite.NewCipher(writeKey)
+		if err != nil {
+			return err
+		}
+		c.readRecord = newStreamRecordCipher(readCipher)
+		c.writeRecord = newStreamRecordCipher(writeCipher)
+		c.enableCrypt = suite.ID() != SUITE_NONE
+	case AEADSuite:
+		if c.readRecord, err = newSuiteRecordCipher(suite, readKey, secret, salt, readInfo); err != nil {
+			return err
+		}
+		if c.writeRecord, err = newSuiteRecordCipher(suite, writeKey, secret, salt, writeInfo); err != nil {
+			return err
+		}
+		c.enableCrypt = true
+	default:
+		return fmt.Errorf("snet: cipher suite %#x is neither StreamSuite nor AEADSuite", suite.ID())
 	}
+	return nil
+}
 
-	conn.readCipher, err = rc4.NewCipher(conn.key[:])
+func newSuiteRecordCipher(suite AEADSuite, key, secret, salt []byte, info string) (*recordCipher, error) {
+	aead, err := suite.NewAEAD(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return conn, nil
+	iv, err := deriveKey(secret, salt, info+" iv", aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return newRecordCipher(aead, iv), nil
 }
 
 func (c *Conn) WrapBaseForTest(wrap func(net.Conn) net.Conn) {
 	c.base = wrap(c.base)
 }
 
-func (c *Conn) RemoteAddr() net.Addr {
-	c.reconnMutex.RLock()
-	defer c.reconnMutex.RUnlock()
-	return c.base.RemoteAddr()
+// 底层连接的地址，重连时更新，读取时不需要 reconnMutex，回调中也可以调用
+type connAddrs struct {
+	local  net.Addr
+	remote net.Addr
 }
 
-func (c *Conn) LocalAddr() net.Addr {
-	c.reconnMutex.RLock()
-	defer c.reconnMutex.RUnlock()
-	return c.base.LocalAddr()
+func (c *Conn) storeAddrs(base net.Conn) {
+	c.addrs.Store(&connAddrs{base.LocalAddr(), base.RemoteAddr()})
 }
 
-func (c *Conn) SetDeadline(t time.Time) error {
-	c.reconnMutex.RLock()
-	defer c.reconnMutex.RUnlock()
-	return c.base.SetDeadline(t)
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addrs.Load().remote
 }
 
-func (c *Conn) SetReadDeadline(t time.Time) error {
-	c.reconnMutex.RLock()
-	defer c.reconnMutex.RUnlock()
-	return c.base.SetReadDeadline(t)
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addrs.Load().local
 }
 
-func (c *Conn) SetWriteDeadline(t time.Time) error {
-	c.reconnMutex.RLock()
-	defer c.reconnMutex.RUnlock()
-	return c.base.SetWriteDeadline(t)
+func (c *Conn) SetReconnWaitTimeout(d time.Duration) {
+	c.reconnWaitTimeout.Store(int64(d))
 }
 
-func (c *Conn) SetReconnWaitTimeout(d time.Duration) {
-	c.reconnWaitTimeout = d
+// SetReconnWaitTimeout 可能与服务端的 reapLoop 并发
+func (c *Conn) reconnWait() time.Duration {
+	return time.Duration(c.reconnWaitTimeout.Load())
 }
 
 func (c *Conn) Close() error {
-	c.trace("Close()")
+	return c.closeWithError(nil)
+}
+
+// 关闭连接并记录原因，之后的 Read 和 Write 都将返回这个错误
+func (c *Conn) closeWithError(err error) error {
+	c.trace("Close(%v)", err)
+	var closing bool
 	c.closeOnce.Do(func() {
+		closing = true
+		c.closeErr = err
 		c.closed = true
 		if c.listener != nil {
 			c.listener.delConn(c.id)
 		}
 		close(c.closeChan)
+		c.log(slog.LevelInfo, "conn closed", "err", err)
+		if c.rewriter.budget != nil || c.rewriter.spool != nil {
+			go c.releaseRewriter()
+		}
 	})
+	// 在 closeOnce 之外调用，OnClosed 中可以再次调用 Close
+	if closing && c.hooks.OnClosed != nil {
+		c.hooks.OnClosed(c, err)
+	}
 	return c.base.Close()
 }
 
+// 连接因为某个原因被关闭时返回这个原因，否则返回 err
+func (c *Conn) closeError(err error) error {
+	select {
+	case <-c.closeChan:
+		if c.closeErr != nil {
+			return c.closeErr
+		}
+	default:
+	}
+	return err
+}
+
 func (c *Conn) TryReconn() {
 	if c.listener == nil {
 		c.reconnMutex.RLock()
@@ -200,7 +641,9 @@ func (c *Conn) TryReconn() {
 }
 
 func (c *Conn) Read(b []byte) (n int, err error) {
-	c.trace("Read(%d)", len(b))
+	if c.tracing() {
+		c.trace("Read(%d)", len(b))
+	}
 	if len(b) == 0 {
 		return
 	}
@@ -209,17 +652,51 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	c.readMutex.Lock()
 	c.trace("Read() wait reconn")
 	c.reconnMutex.RLock()
-	c.readWaiting = true
 
 	defer func() {
-		c.readWaiting = false
-		c.reconnMutex.RUnlock()
+		c.unlockReconn(&c.readUnlocked)
 		c.readMutex.Unlock()
 	}()
 
+	// 关闭后不再返回缓存的数据，交接后这些数据属于新进程
+	select {
+	case <-c.closeChan:
+		return 0, c.closeError(net.ErrClosed)
+	default:
+	}
+
+	if c.readRecord == nil {
+		n, err = c.readRaw(b)
+		if err == nil {
+			if c.enableCrypt {
+				c.readCipher.XORKeyStream(b[:n], b[:n])
+			}
+			c.readCount += uint64(n)
+		}
+	} else {
+		c.lastRecv.Store(time.Now().UnixNano())
+		c.reading.Store(true)
+		n, err = c.readRecords(b)
+		c.reading.Store(false)
+		if err == ErrBadRecord {
+			c.trace("bad record")
+			c.closeWithError(ErrBadRecord)
+		}
+	}
+
+	if c.tracing() {
+		c.trace("Read(), n = %d, err = %v", n, err)
+	}
+	return
+}
+
+// 从重传队列或底层连接读取原始数据，连接断开时等待重连
+func (c *Conn) readRaw(b []byte) (n int, err error) {
 	for {
 		n, err = c.rereader.Pull(b), nil
-		c.trace("read from queue, n = %d", n)
+		if c.tracing() {
+			c.trace("read from queue, n = %d", n)
+		}
 		if n > 0 {
 			break
 		}
@@ -227,33 +704,99 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		base := c.base
 		n, err = base.Read(b[n:])
 		if err == nil {
-			c.trace("read from conn, n = %d", n)
+			if c.tracing() {
+				c.trace("read from conn, n = %d", n)
+			}
+			break
+		}
+
+		// 只有用户会给建立好的底层连接设置超时，超时后底层连接依然可用
+		if errors.Is(err, os.ErrDeadlineExceeded) {
 			break
 		}
 		base.Close()
+		c.lost(err)
 
 		if c.listener == nil {
 			go c.tryReconn(base)
 		}
 
-		if !c.waitReconn('r', c.readWaitChan) {
+		if done, waitErr := c.waitReconn('r'); !done {
+			err = c.closeError(err)
+			if waitErr != nil {
+				err = waitErr
+			}
 			break
 		}
 	}
+	return
+}
 
-	if err == nil {
-		if c.enableCrypt {
-			c.readCipher.XORKeyStream(b[:n], b[:n])
+// 读取并校验记录，未读完的明文留到下一次 Read
+func (c *Conn) readRecords(b []byte) (n int, err error) {
+	for len(c.readPlain) == 0 {
+		size, err := c.readRecord.RecordSize(c.readBuf)
+		if err != nil {
+			return 0, err
 		}
-		c.readCount += uint64(n)
+
+		if size > 0 {
+			typ, plain, err := c.readRecord.Open(c.plainBuf[:0], c.readBuf[:size])
+			if err != nil {
+				return 0, err
+			}
+			c.readBuf = c.readBuf[:copy(c.readBuf, c.readBuf[size:])]
+
+			switch typ {
+			case RECORD_DATA:
+				c.readPlain = plain
+				c.plainBuf = plain[:0]
+			case RECORD_PING:
+				c.trace("recv ping")
+				c.sendControl(controlPong)
+			case RECORD_PONG:
+				c.trace("recv pong")
+			case RECORD_ACK:
+				if err := c.handleAck(plain); err != nil {
+					return 0, err
+				}
+				// pumpAck 收到确认后立即返回，让等待确认的 Write 继续
+				if b == nil {
+					return 0, nil
+				}
+			default:
+				return 0, ErrBadRecord
+			}
+
+			// 只收到确认时不回应，避免双方互相确认
+			if typ != RECORD_ACK {
+				c.received()
+			}
+			continue
+		}
+
+		if c.readBuf == nil {
+			c.readBuf = make([]byte, 0, c.readRecord.MaxRecordSize())
+		}
+
+		m, err := c.readRaw(c.readBuf[len(c.readBuf):cap(c.readBuf)])
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = c.readBuf[:len(c.readBuf)+m]
+		c.readCount += uint64(m)
+		c.lastRecv.Store(time.Now().UnixNano())
 	}
 
-	c.trace("Read(), n = %d, err = %v", n, err)
-	return
+	n = copy(b, c.readPlain)
+	c.readPlain = c.readPlain[n:]
+	return n, nil
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
-	c.trace("Write(%d)", len(b))
+	if c.tracing() {
+		c.trace("Write(%d)", len(b))
+	}
 	if len(b) == 0 {
 		return
 	}
@@ -262,50 +805,107 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	c.writeMutex.Lock()
 	c.trace("Write() wait reconn")
 	c.reconnMutex.RLock()
-	c.writeWaiting = true
 
 	defer func() {
-		c.writeWaiting = false
-		c.reconnMutex.RUnlock()
-		c.writeMutex.Unlock()
+		c.unlockReconn(&c.writeUnlocked)
+		c.unlockWrite()
 	}()
 
-	if c.enableCrypt {
-		c.writeCipher.XORKeyStream(b, b)
+	if deadlinePassed(&c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if c.writeRecord != nil && c.backpressure != BackpressureNone {
+		return c.writeBackpressure(b)
+	}
+	return c.write(b)
+}
+
+// 调用者需持有 writeMutex 和 reconnMutex 的读锁
+func (c *Conn) write(b []byte) (n int, err error) {
+	// 不修改 b，加密后的数据放在 writeBuf 或直接放进重传缓冲区，
+	// 重传缓冲区中的数据跨越尾部时分成 data 和 more 两段写入
+	var data, more []byte
+	if c.writeRecord == nil && c.enableCrypt {
+		c.rewriter.grow(len(b))
 	}
 
-	c.rewriter.Push(b)
-	c.writeCount += uint64(len(b))
+	switch {
+	case c.writeRecord != nil:
+		c.writeBuf = c.sealControl(c.writeBuf[:0])
+		c.writeBuf = c.writeRecord.Seal(c.writeBuf, RECORD_DATA, b)
+		data = c.writeBuf
+		c.pushRewriter(data)
+	case c.enableCrypt && len(b) < len(c.rewriter.data):
+		data, more = c.rewriter.PushXOR(c.writeCipher, b)
+	case c.enableCrypt:
+		c.writeBuf = slices.Grow(c.writeBuf[:0], len(b))[:len(b)]
+		c.writeCipher.XORKeyStream(c.writeBuf, b)
+		data = c.writeBuf
+		c.rewriter.Push(data)
+	default:
+		data = b
+		c.rewriter.Push(data)
+	}
+	c.writeCount += uint64(len(data) + len(more))
+	c.lastSend.Store(time.Now().UnixNano())
 
 	base := c.base
-	n, err = base.Write(b)
+	_, err = base.Write(data)
+	if err == nil && len(more) > 0 {
+		_, err = base.Write(more)
+	}
 	if err == nil {
-		return
+		// 写入期间 Read 留下的心跳回应和确认
+		c.flushControl()
+		return len(b), nil
 	}
 	base.Close()
+	c.lost(err)
 
 	if c.listener == nil {
 		go c.tryReconn(base)
 	}
 
-	if c.waitReconn('w', c.writeWaitChan) {
+	// 超时的数据已经进入重传缓冲区，重连后依然会被发送
+	done, waitErr := c.waitReconn('w')
+	switch {
+	case done:
 		n, err = len(b), nil
+	case waitErr != nil:
+		n, err = len(b), waitErr
+	default:
+		err = c.closeError(err)
 	}
 	return
 }
 
-func (c *Conn) waitReconn(who byte, waitChan chan struct{}) (done bool) {
-	c.trace("waitReconn('%c', \"%s\")", who, c.reconnWaitTimeout)
+// 等待重连完成。超过用户设置的读写超时时返回 os.ErrDeadlineExceeded，
+// 此时重连可能还在进行，不再重新获取 reconnMutex，由 unlockReconn 跳过解锁
+func (c *Conn) waitReconn(who byte) (done bool, err error) {
+	c.trace("waitReconn('%c', \"%s\")", who, c.reconnWait())
+
+	deadline, deadlineChan, unlocked := &c.readDeadline, c.readDeadlineChan, &c.readUnlocked
+	if who == 'w' {
+		deadline, deadlineChan, unlocked = &c.writeDeadline, c.writeDeadlineChan, &c.writeUnlocked
+	}
 
-	timeout := time.NewTimer(c.reconnWaitTimeout)
+	timeout := time.NewTimer(c.reconnWait())
 	defer timeout.Stop()
 
+	deadlineTimer := time.NewTimer(time.Hour)
+	defer deadlineTimer.Stop()
+
+	reconnChan := c.reconnChan
 	c.reconnMutex.RUnlock()
 	defer func() {
+		if err != nil {
+			*unlocked = true
+			return
+		}
 		c.reconnMutex.RLock()
 		if done {
-			<-waitChan
-			c.trace("waitReconn('%c', \"%s\") done", who, c.reconnWaitTimeout)
+			c.trace("waitReconn('%c', \"%s\") done", who, c.reconnWait())
 		}
 	}()
 
@@ -316,25 +916,41 @@ func (c *Conn) waitReconn(who byte, waitChan chan struct{}) (done bool) {
 		lsnCloseChan = c.listener.closeChan
 	}
 
+WAIT:
+	deadlineTimer.Stop()
+	if d := deadline.Load(); d != 0 {
+		deadlineTimer.Reset(time.Until(time.Unix(0, d)))
+	}
+
 	select {
-	case <-waitChan:
+	case <-reconnChan:
 		done = true
-		c.trace("waitReconn('%c', \"%s\") wake up", who, c.reconnWaitTimeout)
+		c.trace("waitReconn('%c', \"%s\") wake up", who, c.reconnWait())
 		return
+	case <-deadlineTimer.C:
+		if d := deadline.Load(); d == 0 || time.Now().UnixNano() < d {
+			goto WAIT
+		}
+		c.trace("waitReconn('%c', \"%s\") deadline exceeded", who, c.reconnWait())
+		err = os.ErrDeadlineExceeded
+		return
+	case <-deadlineChan:
+		goto WAIT
 	case <-c.closeChan:
-		c.trace("waitReconn('%c', \"%s\") closed", who, c.reconnWaitTimeout)
+		c.trace("waitReconn('%c', \"%s\") closed", who, c.reconnWait())
 		return
 	case <-timeout.C:
-		c.trace("waitReconn('%c', \"%s\") timeout", who, c.reconnWaitTimeout)
-		c.Close()
+		c.trace("waitReconn('%c', \"%s\") timeout", who, c.reconnWait())
+		c.closeWithError(ErrSessionExpired)
 		return
 	case <-lsnCloseChan:
-		c.trace("waitReconn('%c', \"%s\") listener closed", who, c.reconnWaitTimeout)
+		c.trace("waitReconn('%c', \"%s\") listener closed", who, c.reconnWait())
+		c.closeWithError(ErrListenerClosed)
 		return
 	}
 }
 
-func (c *Conn) handleReconn(conn net.Conn, writeCount, readCount uint64) {
+func (c *Conn) handleReconn(conn net.Conn, reconnType byte, writeCount, readCount, seq uint64) {
 	var done bool
 
 	c.trace("handleReconn() wait handleReconn()")
@@ -343,13 +959,9 @@ func (c *Conn) handleReconn(conn net.Conn, writeCount, readCount uint64) {
 
 	c.trace("handleReconn() wait Read() or Write()")
 	c.reconnMutex.Lock()
-	readWaiting := c.readWaiting
-	writeWaiting := c.writeWaiting
 	defer func() {
-		c.reconnMutex.Unlock()
-		if done {
-			c.wakeUp(readWaiting, writeWaiting)
-		} else {
+		c.finishReconn()
+		if !done {
 			conn.Close()
 		}
 	}()
@@ -362,42 +974,54 @@ func (c *Conn) handleReconn(conn net.Conn, writeCount, readCount uint64) {
 	)
 
 	if writeCount < c.readCount || c.writeCount < readCount ||
-		int(c.writeCount-readCount) > len(c.rewriter.data) {
+		int(c.writeCount-readCount) > c.rewriter.Buffered() {
 		c.trace("data corruption(\"%s\", %d, %d), c.writeCount = %d, c.readCount = %d",
 			conn.RemoteAddr(), writeCount, readCount, c.writeCount, c.readCount)
 
-		conn.Write(buf[:])
+		c.log(slog.LevelWarn, "reconnect refused", "reason", refuseReason(RECONN_BUFFER_OVERRUN),
+			"remote_addr", conn.RemoteAddr().String(), "write_count", c.writeCount, "read_count", c.readCount,
+			"peer_write_count", writeCount, "peer_read_count", readCount)
+		c.metrics.RewriterOverflow()
+		c.metrics.ReconnectRefused(refuseReason(RECONN_BUFFER_OVERRUN))
+		writeReconnResponse(conn, reconnType, RECONN_BUFFER_OVERRUN, buf[:])
 		return
 	}
 
 	binary.LittleEndian.PutUint64(field1, c.writeCount)
 	binary.LittleEndian.PutUint64(field2, c.readCount)
 	rand.Read(field3)
-	if _, err := conn.Write(buf[:]); err != nil {
+	if err := writeReconnResponse(conn, reconnType, RECONN_OK, buf[:]); err != nil {
 		c.trace("reconn response failed")
 		return
 	}
 
 	// 重连验证
 	c.trace("reconn check")
-	var buf2 [16]byte
+	var buf2 [proofSize]byte
 	if _, err := io.ReadFull(conn, buf2[:]); err != nil {
 		c.trace("read reconn check failed: %s", err)
 		return
 	}
 
-	hash := md5.New()
-	hash.Write(field3)
-	hash.Write(c.key[:])
-	md5sum := hash.Sum(nil)
-	if !bytes.Equal(buf2[:], md5sum) {
-		c.trace("reconn check not equals: %x, %x", buf2[:], md5sum)
+	if !c.checkProof(field3, buf2[:]) {
+		c.trace("reconn check not equals: %x", buf2[:])
+		c.listener.reconnFailed(c)
+		return
+	}
+
+	// 通过挑战验证后才更新序号，重放的请求不能用掉客户端的序号
+	if !c.acceptSeq(seq) {
+		c.trace("stale reconn request: %d", seq)
 		return
 	}
 
 	// 验证成功，关闭旧连接
 	c.base.Close()
+	c.lost(errBaseReplaced)
 	done = c.doReconn(conn, writeCount, readCount)
+	if done {
+		c.reconnFailures.Store(0)
+	}
 }
 
 func (c *Conn) tryReconn(badConn net.Conn) {
@@ -410,14 +1034,7 @@ func (c *Conn) tryReconn(badConn net.Conn) {
 	c.trace("tryReconn() wait Read() or Write()")
 	badConn.Close()
 	c.reconnMutex.Lock()
-	readWaiting := c.readWaiting
-	writeWaiting := c.writeWaiting
-	defer func() {
-		c.reconnMutex.Unlock()
-		if done {
-			c.wakeUp(readWaiting, writeWaiting)
-		}
-	}()
+	defer c.finishReconn()
 	c.trace("tryReconn() begin")
 
 	if badConn != c.base {
@@ -425,91 +1042,178 @@ func (c *Conn) tryReconn(badConn net.Conn) {
 		return
 	}
 
+	// 尝试重连
 	var (
-		preBuf [1]byte
-		buf    [24 + md5.Size]byte
-		buf2   [24]byte
-		buf3   [md5.Size]byte
+		err     error
+		refused error
+		start   = time.Now()
 	)
+	for attempt := 1; !c.closed; attempt++ {
+		if ctxErr := c.reconnCtx.Err(); ctxErr != nil {
+			c.trace("reconn canceled: %v", ctxErr)
+			c.closeWithError(ctxErr)
+			break
+		}
 
-	preBuf[0] = TYPE_RECONN
-	binary.LittleEndian.PutUint64(buf[0:8], c.id)
-	binary.LittleEndian.PutUint64(buf[8:16], c.writeCount)
-	binary.LittleEndian.PutUint64(buf[16:24], c.readCount)
-	hash := md5.New()
-	hash.Write(buf[0:24])
-	hash.Write(c.key[:])
-	copy(buf[24:], hash.Sum(nil))
+		if attempt > 1 {
+			if c.reconnPolicy.giveUp(attempt, time.Since(start), err) {
+				c.trace("reconn gave up: %v", err)
+				c.closeWithError(fmt.Errorf("%w after %d attempts: %w", ErrReconnGaveUp, attempt-1, err))
+				break
+			}
 
-	// 尝试重连
-	for i := 0; !c.closed; i++ {
-		if i > 0 {
-			time.Sleep(time.Second * 3)
+			if !c.sleep(c.reconnPolicy.backoff(attempt)) {
+				continue
+			}
 		}
 
-		c.trace("reconn dial")
-		conn, err := c.dialer()
-		if err != nil {
-			c.trace("dial failed: %v", err)
-			continue
+		if c.reconnPolicy.OnAttempt != nil {
+			c.reconnPolicy.OnAttempt(attempt, err)
 		}
-
-		c.trace("send reconn pre request")
-		if _, err = conn.Write(preBuf[:]); err != nil {
-			c.trace("write pre request failed: %v", err)
-			conn.Close()
-			continue
+		if c.hooks.OnReconnecting != nil {
+			c.hooks.OnReconnecting(c, attempt)
 		}
+		c.metrics.ReconnectAttempt()
 
-		c.trace("send reconn request")
-		if _, err = conn.Write(buf[:]); err != nil {
-			c.trace("write failed: %v", err)
-			conn.Close()
-			continue
+		done, refused, err = c.reconnOnce(c.reconnRequest())
+		if done {
+			c.trace("reconn success")
+			break
 		}
 
-		c.trace("wait reconn response")
-		if _, err = io.ReadFull(conn, buf2[:]); err != nil {
-			c.trace("read failed: %v", err)
-			conn.Close()
-			continue
-		}
-		writeCount := binary.LittleEndian.Uint64(buf2[0:8])
-		readCount := binary.LittleEndian.Uint64(buf2[8:16])
-		challengeCode := binary.LittleEndian.Uint64(buf2[16:24])
-		if writeCount == 0 && readCount == 0 && challengeCode == 0 {
-			c.trace("The server refused to reconnect")
-			conn.Close()
-			c.Close()
+		if refused != nil {
+			c.closeWithError(refused)
 			break
 		}
+	}
+}
 
-		c.trace("reconn check")
-		hash := md5.New()
-		hash.Write(buf2[16:24])
-		hash.Write(c.key[:])
-		copy(buf3[:], hash.Sum(nil))
-		if _, err = conn.Write(buf3[:]); err != nil {
-			c.trace("write reconn check response failed: %v", err)
-			conn.Close()
-			continue
-		}
+// 进行一次重连尝试，服务端拒绝重连或数据无法恢复时返回 refused
+func (c *Conn) reconnOnce(req []byte) (done bool, refused, err error) {
+	c.trace("reconn dial")
+	// 重定向的地址只用于下一次尝试，失败后回到原来的拨号方式
+	var conn net.Conn
+	if addr := c.redirectAddr; addr != "" {
+		c.redirectAddr = ""
+		conn, err = c.redirectDialer(c.reconnCtx, addr)
+	} else {
+		conn, err = c.dialer(c.reconnCtx)
+	}
+	if err != nil {
+		c.trace("dial failed: %v", err)
+		return
+	}
 
-		if writeCount < c.readCount || c.writeCount < readCount ||
-			int(c.writeCount-readCount) > len(c.rewriter.data) {
-			c.trace("Data corruption, cannot be reconnected")
+	stop := watchContext(c.reconnCtx, conn)
+	defer func() {
+		stop()
+		if done {
+			conn.SetDeadline(time.Time{})
+		} else {
 			conn.Close()
-			c.Close()
-			break
 		}
+		if err != nil && c.reconnCtx.Err() != nil {
+			err = c.reconnCtx.Err()
+		}
+	}()
 
-		if c.doReconn(conn, writeCount, readCount) {
-			c.trace("reconn success")
-			done = true
-			break
+	c.trace("send reconn request")
+	if _, err = conn.Write(req); err != nil {
+		c.trace("write failed: %v", err)
+		return
+	}
+
+	var (
+		buf  [1 + 24]byte
+		resp = buf[1:]
+	)
+
+	c.trace("wait reconn response")
+	if c.legacy {
+		resp = buf[:24]
+		_, err = io.ReadFull(conn, resp)
+	} else {
+		_, err = io.ReadFull(conn, buf[:])
+	}
+	if err != nil {
+		c.trace("read failed: %v", err)
+		return
+	}
+	writeCount := binary.LittleEndian.Uint64(resp[0:8])
+	readCount := binary.LittleEndian.Uint64(resp[8:16])
+	challengeCode := binary.LittleEndian.Uint64(resp[16:24])
+	if c.legacy && writeCount == 0 && readCount == 0 && challengeCode == 0 {
+		c.trace("The server refused to reconnect")
+		c.log(slog.LevelWarn, "reconnect refused", "reason", "refused")
+		c.metrics.ReconnectRefused("refused")
+		refused = ErrReconnectRefused
+		return
+	}
+	if !c.legacy && buf[0] == RECONN_SESSION_MIGRATED && c.redirectDialer != nil {
+		var addr string
+		if addr, err = readRedirect(conn); err == nil {
+			c.trace("reconn redirected to %s", addr)
+			c.log(slog.LevelInfo, "reconnect redirected", "node_addr", addr)
+			c.redirectAddr, err = addr, errRedirected
 		}
-		conn.Close()
+		return
+	}
+	if !c.legacy && buf[0] == RECONN_TRY_LATER {
+		c.trace("The server asked to reconnect later")
+		err = errTryLater
+		return
+	}
+	// 重放的请求抢先用掉了序号，下次尝试使用新的序号
+	if !c.legacy && buf[0] == RECONN_STALE_REQUEST {
+		c.trace("The server rejected a stale reconn request")
+		err = ErrStaleRequest
+		return
+	}
+	if !c.legacy && buf[0] != RECONN_OK {
+		c.trace("The server refused to reconnect: %d", buf[0])
+		c.log(slog.LevelWarn, "reconnect refused", "reason", refuseReason(buf[0]))
+		c.metrics.ReconnectRefused(refuseReason(buf[0]))
+		refused = refuseError(buf[0])
+		return
+	}
+
+	c.trace("reconn check")
+	if _, err = conn.Write(c.makeProof(resp[16:24])); err != nil {
+		c.trace("write reconn check response failed: %v", err)
+		return
+	}
+
+	if writeCount < c.readCount || c.writeCount < readCount ||
+		int(c.writeCount-readCount) > c.rewriter.Buffered() {
+		c.trace("Data corruption, cannot be reconnected")
+		c.log(slog.LevelWarn, "reconnect refused", "reason", refuseReason(RECONN_BUFFER_OVERRUN),
+			"write_count", c.writeCount, "read_count", c.readCount,
+			"peer_write_count", writeCount, "peer_read_count", readCount)
+		c.metrics.RewriterOverflow()
+		c.metrics.ReconnectRefused(refuseReason(RECONN_BUFFER_OVERRUN))
+		refused = ErrBufferOverrun
+		return
+	}
+
+	if !c.doReconn(conn, writeCount, readCount) {
+		err = errRetransmit
+		return
 	}
+	done = true
+	return
+}
+
+// 等待重连间隔，连接被关闭或重连被取消时返回 false
+func (c *Conn) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closeChan:
+	case <-c.reconnCtx.Done():
+	}
+	return false
 }
 
 func (c *Conn) doReconn(conn net.Conn, writeCount, readCount uint64) bool {
@@ -518,6 +1222,9 @@ func (c *Conn) doReconn(conn net.Conn, writeCount, readCount uint64) bool {
 		conn.RemoteAddr(), writeCount, readCount, c.writeCount, c.readCount,
 	)
 
+	// 队列中未读取的数据会被对方从 c.readCount 开始重新发送
+	c.rereader = rereader{}
+
 	rereadWaitChan := make(chan bool)
 	if writeCount != c.readCount {
 		go func() {
@@ -551,36 +1258,41 @@ func (c *Conn) doReconn(conn net.Conn, writeCount, readCount uint64) bool {
 		c.trace("reread done")
 	}
 
+	var latency time.Duration
+	if lostAt := c.lostAt.Load(); lostAt != 0 {
+		latency = time.Since(time.Unix(0, lostAt))
+	}
+
 	c.base = conn
+	c.storeAddrs(conn)
+	c.lastRecv.Store(time.Now().UnixNano())
+	c.lostAt.Store(0)
+	c.acked(readCount)
+	c.wakeUp()
+
+	rewrite, reread := int(c.writeCount-readCount), int(writeCount-c.readCount)
+	c.log(slog.LevelInfo, "reconnected", "remote_addr", conn.RemoteAddr().String(),
+		"write_count", c.writeCount, "read_count", c.readCount,
+		"rewrite", rewrite, "reread", reread, "latency", latency)
+	c.metrics.Reconnected(latency, rewrite, reread)
+	if c.hooks.OnReconnected != nil {
+		c.hooks.OnReconnected(c, rewrite, reread)
+	}
 	return true
 }
 
-func (c *Conn) wakeUp(readWaiting, writeWaiting bool) {
-	if readWaiting {
-		c.trace("continue read")
-		// make sure reader take over reconnMutex
-		for i := 0; i < 2; i++ {
-			select {
-			case c.readWaitChan <- struct{}{}:
-			case <-c.closeChan:
-				c.trace("continue read closed")
-				return
-			}
-		}
-		c.trace("continue read done")
-	}
+// 唤醒所有在 waitReconn 中等待的 Read 和 Write，调用者需持有 reconnMutex
+func (c *Conn) wakeUp() {
+	c.trace("wake up")
+	close(c.reconnChan)
+	c.reconnChan = make(chan struct{})
+}
 
-	if writeWaiting {
-		c.trace("continue write")
-		// make sure writer take over reconnMutex
-		for i := 0; i < 2; i++ {
-			select {
-			case c.writeWaitChan <- struct{}{}:
-			case <-c.closeChan:
-				c.trace("continue write closed")
-				return
-			}
-		}
-		c.trace("continue write done")
+// Read 和 Write 结束时释放 reconnMutex，waitReconn 超时返回时已经释放过了
+func (c *Conn) unlockReconn(unlocked *bool) {
+	if *unlocked {
+		*unlocked = false
+		return
 	}
+	c.reconnMutex.RUnlock()
 }
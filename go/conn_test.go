@@ -2,9 +2,11 @@ package snet
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
@@ -74,8 +76,11 @@ func ConnTest(t *testing.T, unstable, encrypt, reconn bool) {
 		RewriterBufferSize: 1024,
 		ReconnWaitTimeout:  time.Minute * 5,
 	}
+	ConfigConnTest(t, config, config, unstable, reconn)
+}
 
-	listener, err := Listen(config, func() (net.Listener, error) {
+func ConfigConnTest(t *testing.T, srvConfig, cliConfig Config, unstable, reconn bool) {
+	listener, err := Listen(srvConfig, func() (net.Listener, error) {
 		l, err := net.Listen("tcp", "0.0.0.0:0")
 		if err != nil {
 			return nil, err
@@ -95,7 +100,7 @@ func ConnTest(t *testing.T, unstable, encrypt, reconn bool) {
 	go func() {
 		conn, err := listener.Accept()
 		if err != nil {
-			t.Fatalf("accept failed: %s", err.Error())
+			t.Errorf("accept failed: %s", err.Error())
 			return
 		}
 		//if unstable {
@@ -107,7 +112,7 @@ func ConnTest(t *testing.T, unstable, encrypt, reconn bool) {
 		wg.Done()
 	}()
 
-	conn, err := Dial(config, func() (net.Conn, error) {
+	conn, err := Dial(cliConfig, func() (net.Conn, error) {
 		conn, err := net.Dial("tcp", listener.Addr().String())
 		if err != nil {
 			return nil, err
@@ -135,16 +140,13 @@ func ConnTest(t *testing.T, unstable, encrypt, reconn bool) {
 	err = conn.SetWriteDeadline(time.Time{})
 	utest.IsNilNow(t, err)
 
-	conn.(*Conn).SetReconnWaitTimeout(config.ReconnWaitTimeout)
+	conn.(*Conn).SetReconnWaitTimeout(cliConfig.ReconnWaitTimeout)
 
 	time.Sleep(100 * time.Millisecond)
 	for i := 0; i < 100000; i++ {
 		b := RandBytes(100)
-		c := b
-		if encrypt {
-			c = make([]byte, len(b))
-			copy(c, b)
-		}
+		c := make([]byte, len(b))
+		copy(c, b)
 
 		if _, err := conn.Write(b); err != nil {
 			t.Fatalf("write failed: %s", err.Error())
@@ -176,6 +178,17 @@ func ConnTest(t *testing.T, unstable, encrypt, reconn bool) {
 	wg.Wait()
 }
 
+func LegacyConnTest(t *testing.T, unstable, encrypt, reconn bool) {
+	config := Config{
+		EnableCrypt:        encrypt,
+		HandshakeTimeout:   time.Second * 5,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute * 5,
+		LegacyHandshake:    true,
+	}
+	ConfigConnTest(t, config, config, unstable, reconn)
+}
+
 func Test_Stable_NoEncrypt(t *testing.T) {
 	ConnTest(t, false, false, false)
 }
@@ -208,12 +221,46 @@ func Test_Unstable_Encrypt_Reconn(t *testing.T) {
 	ConnTest(t, true, true, true)
 }
 
-func reconnTest(t *testing.T, errorType int) {
+func Test_Legacy_Unstable_NoEncrypt_Reconn(t *testing.T) {
+	LegacyConnTest(t, true, false, true)
+}
+
+func Test_Legacy_Unstable_Encrypt_Reconn(t *testing.T) {
+	LegacyConnTest(t, true, true, true)
+}
+
+func Test_Legacy_Disabled(t *testing.T) {
+	config := Config{
+		EnableCrypt:        true,
+		HandshakeTimeout:   time.Second * 5,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute * 5,
+	}
+
+	listener, err := Listen(config, func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	defer listener.Close()
+
+	config.LegacyHandshake = true
+	_, err = Dial(config, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	})
+	if err == nil {
+		t.Fatalf("legacy handshake should be refused")
+	}
+}
+
+func reconnTest(t *testing.T, errorType int, legacy bool, expect error) {
 	config := Config{
 		EnableCrypt:        true,
 		HandshakeTimeout:   time.Second * 5,
 		RewriterBufferSize: 1024,
 		ReconnWaitTimeout:  time.Minute * 5,
+		LegacyHandshake:    legacy,
 	}
 
 	listener, err := Listen(config, func() (net.Listener, error) {
@@ -234,7 +281,7 @@ func reconnTest(t *testing.T, errorType int) {
 	go func() {
 		conn, err := listener.Accept()
 		if err != nil {
-			t.Fatalf("accept failed: %s", err.Error())
+			t.Errorf("accept failed: %s", err.Error())
 			return
 		}
 
@@ -286,8 +333,8 @@ func reconnTest(t *testing.T, errorType int) {
 	conn.(*Conn).TryReconn()
 	time.Sleep(100 * time.Millisecond)
 
-	if _, err := conn.Write(b); err == nil {
-		t.Fatalf("check has error")
+	if _, err := conn.Write(b); err != expect {
+		t.Fatalf("err = %v, want %v", err, expect)
 		return
 	}
 
@@ -297,23 +344,30 @@ func reconnTest(t *testing.T, errorType int) {
 }
 
 func Test_Reconn1(t *testing.T) {
-	reconnTest(t, 1)
+	reconnTest(t, 1, false, ErrBufferOverrun)
 }
 
 func Test_Reconn2(t *testing.T) {
-	reconnTest(t, 2)
+	reconnTest(t, 2, false, ErrBufferOverrun)
 }
 
 func Test_Reconn3(t *testing.T) {
-	reconnTest(t, 3)
+	reconnTest(t, 3, false, ErrBufferOverrun)
 }
 
 func Test_Reconn4(t *testing.T) {
-	reconnTest(t, 4)
+	reconnTest(t, 4, false, ErrUnknownSession)
 }
 
 func Test_Reconn5(t *testing.T) {
-	reconnTest(t, 5)
+	reconnTest(t, 5, false, ErrAuthFailed)
+}
+
+func Test_Reconn_Legacy(t *testing.T) {
+	reconnTest(t, 1, true, ErrBufferOverrun)
+	reconnTest(t, 2, true, ErrReconnectRefused)
+	reconnTest(t, 4, true, ErrReconnectRefused)
+	reconnTest(t, 5, true, ErrReconnectRefused)
 }
 
 func handShakeTest(t *testing.T, errType int) {
@@ -322,6 +376,7 @@ func handShakeTest(t *testing.T, errType int) {
 		HandshakeTimeout:   time.Second * 5,
 		RewriterBufferSize: 1024,
 		ReconnWaitTimeout:  time.Minute * 5,
+		LegacyHandshake:    true,
 	}
 
 	listener, err := Listen(config, func() (net.Listener, error) {
@@ -340,8 +395,8 @@ func handShakeTest(t *testing.T, errType int) {
 	go func() {
 		conn, err := listener.Accept()
 		if err != nil {
-			if err != os.ErrInvalid {
-				t.Fatalf("accept failed: %s", err.Error())
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("accept failed: %s", err.Error())
 			}
 			return
 		}
@@ -372,7 +427,7 @@ func handShakeTest(t *testing.T, errType int) {
 	}
 	// 测试错误连接类型
 	if errType == 2 {
-		preBuf[0] = byte(1)
+		preBuf[0] = byte(0x7F)
 	}
 
 	if n, err := conn.Write(preBuf[:]); n != len(preBuf) || err != nil {
@@ -407,8 +462,8 @@ func handShakeTest(t *testing.T, errType int) {
 	srvPubKey := binary.LittleEndian.Uint64(field1)
 	secret := dh64.Secret(privKey, srvPubKey)
 
-	sconn, err := newConn(conn, 0, secret, config)
-	if err != nil {
+	sconn := newConn(conn, 0, legacyKey(secret), config)
+	if err := sconn.useLegacyCipher(); err != nil {
 		t.Fatalf("new conn failed: %s", err.Error())
 	}
 
@@ -423,7 +478,7 @@ func handShakeTest(t *testing.T, errType int) {
 	var buf2 [md5.Size]byte
 	hash := md5.New()
 	hash.Write(field3)
-	hash.Write(sconn.key[:])
+	hash.Write(sconn.key)
 	copy(buf2[:], hash.Sum(nil))
 
 	// 测试错误二次握手响应
@@ -467,3 +522,211 @@ func Test_Handshake5(t *testing.T) {
 func Test_Handshake6(t *testing.T) {
 	handShakeTest(t, 6)
 }
+
+// 只接受连接不响应握手的服务端
+func silentListen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return l
+}
+
+func Test_DialContext_Timeout(t *testing.T) {
+	l := silentListen(t)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var d net.Dialer
+	_, err := DialContext(ctx, Config{}, func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func Test_DialContext_Cancel(t *testing.T) {
+	l := silentListen(t)
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := DialContext(ctx, Config{}, func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+// 握手的最后一次写入之后 ctx 结束，等到 watchContext 打断读写之后才返回
+type cancelConn struct {
+	net.Conn
+	cancel context.CancelFunc
+	writes int
+	fired  chan struct{}
+}
+
+func (c *cancelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.writes++; c.writes == 2 {
+		c.cancel()
+		<-c.fired
+	}
+	return n, err
+}
+
+func (c *cancelConn) SetDeadline(t time.Time) error {
+	if t.Equal(time.Unix(1, 0)) {
+		close(c.fired)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func Test_DialContext_CancelAfterHandshake(t *testing.T) {
+	listener := testListen(t, Config{})
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := DialContext(ctx, Config{}, func(ctx context.Context) (net.Conn, error) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return &cancelConn{Conn: conn, cancel: cancel, fired: make(chan struct{})}, nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func Test_DialContext_HandshakeTimeout(t *testing.T) {
+	l := silentListen(t)
+	defer l.Close()
+
+	config := Config{HandshakeTimeout: 100 * time.Millisecond}
+	_, err := Dial(config, func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func Test_Dial_DialerDeadline(t *testing.T) {
+	l := silentListen(t)
+	defer l.Close()
+
+	// 没有 ctx 和 HandshakeTimeout 时，dialer 自己设置的超时也能结束握手
+	_, err := Dial(Config{}, func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		}
+		return conn, err
+	})
+	if !errors.Is(err, ErrHandshakeFailed) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want ErrHandshakeFailed", err)
+	}
+}
+
+func Test_ReconnectContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	config := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		ReconnectContext:   ctx,
+		ReconnectPolicy:    ReconnectPolicy{InitialBackoff: time.Hour},
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer conn.Close()
+	listener.Close()
+	sconn.Close()
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func discardTestConn(t testing.TB, suite CipherSuite) *Conn {
+	config := Config{RewriterBufferSize: 64 * 1024}
+	// newConn 会读取底层连接的地址
+	base, _ := net.Pipe()
+	if suite == nil {
+		c := newConn(discardConn{base}, 0, legacyKey(1), config)
+		c.enableCrypt = true
+		if err := c.useLegacyCipher(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newConn(discardConn{base}, 0, nil, config)
+	if err := c.useSuite(suite, make([]byte, 32), nil, true); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_Write_NotMutating(t *testing.T) {
+	for _, suite := range []CipherSuite{nil, RC4Suite, AES128CTRSuite, AES128GCMSuite} {
+		c := discardTestConn(t, suite)
+		for _, size := range []int{1, 1000, 100 * 1024} {
+			b := RandBytes(size)
+			raw := append([]byte(nil), b...)
+			if _, err := c.Write(b); err != nil {
+				t.Fatalf("write failed: %s", err)
+			}
+			if !bytes.Equal(b, raw) {
+				t.Fatalf("write modified the buffer, suite = %v, size = %d", suite, size)
+			}
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, suite CipherSuite) {
+	c := discardTestConn(b, suite)
+	buf := make([]byte, 1024)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Write(buf)
+	}
+}
+
+func Benchmark_Write_Legacy(b *testing.B) {
+	benchmarkWrite(b, nil)
+}
+
+func Benchmark_Write_AES128CTR(b *testing.B) {
+	benchmarkWrite(b, AES128CTRSuite)
+}
+
+func Benchmark_Write_AES128GCM(b *testing.B) {
+	benchmarkWrite(b, AES128GCMSuite)
+}
@@ -0,0 +1,102 @@
+package snet
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"time"
+)
+
+// 等待发送的控制记录，多个 goroutine 可以同时设置，由持有 writeMutex 的一方统一发送
+const (
+	controlPing uint32 = 1 << iota
+	controlPong
+	controlAck
+)
+
+// 在 Read 或后台 goroutine 中发送控制记录，调用者需持有 reconnMutex 的读锁。
+// Write 正在进行时由 Write 代为发送
+func (c *Conn) sendControl(control uint32) {
+	c.pending.Or(control)
+	if c.writeMutex.TryLock() {
+		c.flushControl()
+		c.unlockWrite()
+		return
+	}
+	// 可能有 Write 正在等待对方确认
+	c.notifyAck()
+}
+
+// 释放 writeMutex，持有锁期间其它 goroutine 留下的控制记录在这里补发，
+// 正在重连时留给重连后的 Write 或心跳发送
+func (c *Conn) unlockWrite() {
+	c.writeMutex.Unlock()
+	for c.pending.Load() != 0 && c.writeMutex.TryLock() {
+		if !c.reconnMutex.TryRLock() {
+			c.writeMutex.Unlock()
+			return
+		}
+		c.flushControl()
+		c.reconnMutex.RUnlock()
+		c.writeMutex.Unlock()
+	}
+}
+
+// 调用者需持有 writeMutex 和 reconnMutex 的读锁，写入失败时关闭底层连接，记录在重连后重传
+func (c *Conn) flushControl() {
+	if c.writeRecord == nil || c.pending.Load() == 0 {
+		return
+	}
+
+	c.writeBuf = c.sealControl(c.writeBuf[:0])
+	c.pushRewriter(c.writeBuf)
+	c.writeCount += uint64(len(c.writeBuf))
+	c.lastSend.Store(time.Now().UnixNano())
+
+	if _, err := c.base.Write(c.writeBuf); err != nil {
+		c.trace("write control record failed: %v", err)
+		c.base.Close()
+		c.lost(err)
+	}
+}
+
+// 把等待发送的控制记录追加到 dst，调用者需持有 writeMutex
+func (c *Conn) sealControl(dst []byte) []byte {
+	pending := c.pending.Swap(0)
+	if pending&controlPing != 0 {
+		dst = c.writeRecord.Seal(dst, RECORD_PING, nil)
+	}
+	if pending&controlPong != 0 {
+		dst = c.writeRecord.Seal(dst, RECORD_PONG, nil)
+	}
+	if pending&controlAck != 0 {
+		n := c.recvCount.Load()
+		c.ackSent.Store(n)
+		binary.LittleEndian.PutUint64(c.ackBuf[:], n)
+		dst = c.writeRecord.Seal(dst, RECORD_ACK, c.ackBuf[:])
+	}
+	return dst
+}
+
+// 放入重传缓冲区前先丢弃对方已确认的数据，扩容后仍然放不下时对方未确认的数据将被覆盖，
+// 之后断线将无法重连，提前记录下来。调用者需持有 writeMutex
+func (c *Conn) pushRewriter(b []byte) {
+	if c.peerAcked.Load() != 0 {
+		unacked := c.unacked()
+		c.rewriter.trim(unacked)
+		c.rewriter.grow(len(b))
+
+		overflow := c.rewriter.Buffered()+len(b) > c.rewriter.capacity()
+		if overflow && !c.overflowed {
+			c.log(slog.LevelWarn, "unacked data overwritten", "unacked", unacked,
+				"write", len(b), "buffer_size", c.rewriter.capacity())
+			c.metrics.RewriterOverflow()
+		}
+		c.overflowed = overflow
+	}
+	c.rewriter.Push(b)
+}
+
+// 已发送但对方还未确认的字节数，对方不发送确认时为全部已发送的字节数。调用者需持有 writeMutex
+func (c *Conn) unacked() uint64 {
+	return c.writeCount - min(c.peerAcked.Load(), c.writeCount)
+}
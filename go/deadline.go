@@ -0,0 +1,87 @@
+package snet
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 读写超时记录在 Conn 上，重连后重新设置到新的底层连接，同时限制 waitReconn 的等待时间
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, c.readDeadlineChan, t)
+	return c.applyDeadline(func() error {
+		return c.base.SetReadDeadline(loadDeadline(&c.readDeadline))
+	})
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&c.writeDeadline, c.writeDeadlineChan, t)
+	return c.applyDeadline(func() error {
+		return c.base.SetWriteDeadline(loadDeadline(&c.writeDeadline))
+	})
+}
+
+func storeDeadline(deadline *atomic.Int64, changed chan struct{}, t time.Time) {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	deadline.Store(d)
+
+	// 通知 waitReconn 重新计时
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+func loadDeadline(deadline *atomic.Int64) time.Time {
+	if d := deadline.Load(); d != 0 {
+		return time.Unix(0, d)
+	}
+	return time.Time{}
+}
+
+// 重连期间不等待，重连结束时 finishReconn 会把超时设置到新的底层连接上
+func (c *Conn) applyDeadline(apply func() error) error {
+	if !c.reconnMutex.TryRLock() {
+		return nil
+	}
+	defer c.reconnMutex.RUnlock()
+	return apply()
+}
+
+// 调用者需持有 reconnMutex
+func (c *Conn) applyDeadlines() (read, write int64) {
+	read, write = c.readDeadline.Load(), c.writeDeadline.Load()
+	c.base.SetReadDeadline(loadDeadline(&c.readDeadline))
+	c.base.SetWriteDeadline(loadDeadline(&c.writeDeadline))
+	return
+}
+
+// 把超时设置到底层连接上并释放 reconnMutex。
+// 设置和释放之间修改的超时在 applyDeadline 中拿不到锁，释放后发现变化时重新设置；
+// 不能重新加写锁，Read 可能正持有读锁等待这个超时
+func (c *Conn) finishReconn() {
+	read, write := c.applyDeadlines()
+	c.reconnMutex.Unlock()
+	for read != c.readDeadline.Load() || write != c.writeDeadline.Load() {
+		// 新的重连拿到了锁，由它在释放时设置
+		if !c.reconnMutex.TryRLock() {
+			return
+		}
+		read, write = c.applyDeadlines()
+		c.reconnMutex.RUnlock()
+	}
+}
+
+func deadlinePassed(deadline *atomic.Int64) bool {
+	d := deadline.Load()
+	return d != 0 && time.Now().UnixNano() >= d
+}
@@ -0,0 +1,215 @@
+package snet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var deadlineConfig = Config{
+	RewriterBufferSize: 1024,
+	ReconnWaitTimeout:  time.Minute,
+	ReconnectPolicy:    ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func readHello(t *testing.T, conn *Conn) {
+	var buf [5]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if string(buf[:]) != "hello" {
+		t.Fatalf("buf = %q", buf[:])
+	}
+}
+
+func Test_Deadline_Read(t *testing.T) {
+	listener, conn, sconn := testConns(t, deadlineConfig, deadlineConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	base := conn.baseForTest()
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	sconn.Write([]byte("hello"))
+	readHello(t, conn)
+
+	if conn.baseForTest() != base {
+		t.Fatalf("read timeout caused reconnect")
+	}
+}
+
+func Test_Deadline_WaitReconn(t *testing.T) {
+	listener, conn, sconn := testConns(t, deadlineConfig, deadlineConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 重连在 dialGate 关闭之前无法完成
+	dialGate := make(chan struct{})
+	dial := conn.dialer
+	conn.dialer = func(ctx context.Context) (net.Conn, error) {
+		<-dialGate
+		return dial(ctx)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	conn.baseForTest().Close()
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("waited %s for reconnect after deadline", d)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	close(dialGate)
+	sconn.Write([]byte("hello"))
+	readHello(t, conn)
+}
+
+func Test_Deadline_Reapplied(t *testing.T) {
+	listener, conn, _ := testConns(t, deadlineConfig, deadlineConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	base := conn.baseForTest()
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	conn.TryReconn()
+	base.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+	if conn.baseForTest() == base {
+		t.Fatalf("conn not reconnected")
+	}
+}
+
+// 第一次 SetWriteDeadline 时调用 hook
+type deadlineHookConn struct {
+	net.Conn
+	hook atomic.Pointer[func()]
+}
+
+func (c *deadlineHookConn) SetWriteDeadline(t time.Time) error {
+	if hook := c.hook.Swap(nil); hook != nil {
+		(*hook)()
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func Test_Deadline_SetDuringUnlock(t *testing.T) {
+	listener, conn, sconn := testConns(t, deadlineConfig, deadlineConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	hc := &deadlineHookConn{}
+	conn.WrapBaseForTest(func(base net.Conn) net.Conn {
+		hc.Conn = base
+		return hc
+	})
+
+	// 重连结束时设置完超时、释放锁之前，应用层设置了新的超时
+	hook := func() {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	}
+	hc.hook.Store(&hook)
+	conn.reconnMutex.Lock()
+	conn.finishReconn()
+
+	time.AfterFunc(2*time.Second, func() {
+		sconn.Write([]byte("hello"))
+	})
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+}
+
+type clearDeadlineListener struct {
+	net.Listener
+	accepted chan struct{}
+}
+
+func (l *clearDeadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &clearDeadlineConn{conn, l.accepted}, nil
+}
+
+// 清除超时的调用尽量等到应用层取走会话并设置了超时之后才执行
+type clearDeadlineConn struct {
+	net.Conn
+	accepted chan struct{}
+}
+
+func (c *clearDeadlineConn) wait(t time.Time) {
+	if t.IsZero() {
+		select {
+		case <-c.accepted:
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func (c *clearDeadlineConn) SetDeadline(t time.Time) error {
+	c.wait(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *clearDeadlineConn) SetReadDeadline(t time.Time) error {
+	c.wait(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func Test_Deadline_AfterAccept(t *testing.T) {
+	config := deadlineConfig
+	config.HandshakeTimeout = time.Second
+	accepted := make(chan struct{})
+	listener, err := Listen(config, func() (net.Listener, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		return &clearDeadlineListener{l, accepted}, err
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	conn, err := Dial(config, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+	sconn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+
+	// Accept 之后马上设置的超时不能被握手清除
+	sconn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	close(accepted)
+	time.AfterFunc(2*time.Second, func() {
+		conn.Write([]byte("hello"))
+	})
+	if _, err := sconn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+}
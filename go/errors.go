@@ -0,0 +1,51 @@
+package snet
+
+import (
+	"errors"
+	"net"
+)
+
+// 错误的分类，具体的错误可以用 errors.Is 判断属于哪一类
+var (
+	// 会话等待重连超时或客户端放弃重连
+	ErrReconnectTimeout = newError("snet: reconnect timeout", true, net.ErrClosed)
+
+	// 对方拒绝重连
+	ErrReconnectRefused = newError("snet: reconnect refused", false, net.ErrClosed)
+
+	// 重传缓冲区无法补齐断线期间的数据
+	ErrDataLost = newError("snet: data lost", false, net.ErrClosed)
+
+	// Dial 时握手失败，ctx 或 HandshakeTimeout 结束时返回 ctx.Err()
+	ErrHandshakeFailed = newError("snet: handshake failed", false)
+
+	// 等待重连时 Listener 被关闭
+	ErrListenerClosed = newError("snet: listener closed", false, net.ErrClosed)
+)
+
+// Error 实现 net.Error，连接因此关闭的错误包装了 net.ErrClosed，
+// 可以用 errors.Is(err, net.ErrClosed) 判断连接已经不可用
+type Error struct {
+	msg     string
+	timeout bool
+	wrapped []error
+}
+
+func newError(msg string, timeout bool, wrapped ...error) error {
+	return &Error{msg, timeout, wrapped}
+}
+
+func (e *Error) Error() string   { return e.msg }
+func (e *Error) Timeout() bool   { return e.timeout }
+func (e *Error) Temporary() bool { return false }
+func (e *Error) Unwrap() []error { return e.wrapped }
+
+// 具体的错误继承分类的 Timeout
+func subError(msg string, kinds ...error) error {
+	var timeout bool
+	for _, kind := range kinds {
+		var e *Error
+		timeout = timeout || errors.As(kind, &e) && e.timeout
+	}
+	return newError(msg, timeout, kinds...)
+}
@@ -0,0 +1,95 @@
+package snet
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Errors(t *testing.T) {
+	for _, c := range []struct {
+		err     error
+		kind    error
+		timeout bool
+		closed  bool
+	}{
+		{ErrSessionExpired, ErrReconnectTimeout, true, true},
+		{ErrReconnGaveUp, ErrReconnectTimeout, true, true},
+		{ErrUnknownSession, ErrReconnectRefused, false, true},
+		{ErrServerShutdown, ErrReconnectRefused, false, true},
+		{ErrBufferOverrun, ErrDataLost, false, true},
+		{ErrBufferOverrun, ErrReconnectRefused, false, true},
+		{ErrReconnRefused, ErrReconnectRefused, false, true},
+		{ErrHeartbeatTimeout, ErrHeartbeatTimeout, true, false},
+		{ErrNoProof, ErrHandshakeFailed, false, false},
+		{ErrNoCipherSuite, ErrHandshakeFailed, false, false},
+		{ErrBackpressure, ErrBackpressure, false, false},
+	} {
+		var netErr net.Error
+		if !errors.Is(c.err, c.kind) || !errors.As(c.err, &netErr) ||
+			netErr.Timeout() != c.timeout || errors.Is(c.err, net.ErrClosed) != c.closed {
+			t.Fatalf("%v: kind = %v, timeout = %v, closed = %v", c.err, c.kind, c.timeout, c.closed)
+		}
+	}
+}
+
+func Test_Errors_ReconnectTimeout(t *testing.T) {
+	config := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  100 * time.Millisecond,
+	}
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+
+	// 客户端关闭后服务端等待重连超时
+	conn.Close()
+	_, err := sconn.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.Is(err, ErrReconnectTimeout) || !errors.Is(err, net.ErrClosed) ||
+		!errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func Test_Errors_ListenerClosed(t *testing.T) {
+	config := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+	listener, conn, sconn := testConns(t, config, config)
+	defer conn.Close()
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept err = %v", err)
+	}
+
+	// 等待重连时 Listener 已经关闭
+	sconn.baseForTest().Close()
+	if _, err := sconn.Read(make([]byte, 1)); !errors.Is(err, ErrListenerClosed) || !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read err = %v", err)
+	}
+}
+
+func Test_Errors_HandshakeFailed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	_, err = Dial(Config{}, func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("err = %v, want ErrHandshakeFailed", err)
+	}
+}
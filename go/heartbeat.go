@@ -0,0 +1,47 @@
+package snet
+
+import "time"
+
+var ErrHeartbeatTimeout = newError("snet: heartbeat timeout", true)
+
+// 只有记录层的连接才能发送心跳
+func (c *Conn) startHeartbeat() {
+	if c.heartbeatInterval > 0 && c.writeRecord != nil {
+		go c.heartbeatLoop()
+	}
+}
+
+func (c *Conn) heartbeatLoop() {
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.heartbeat()
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+// 只在 Read 等待数据时检查超时，应用层不读取时对方的心跳回应无人处理，不能算作对方失联
+func (c *Conn) heartbeat() {
+	c.reconnMutex.RLock()
+	defer c.reconnMutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	if c.reading.Load() && time.Duration(now-c.lastRecv.Load()) > c.heartbeatTimeout {
+		c.trace("heartbeat timeout")
+		c.base.Close()
+		c.lost(ErrHeartbeatTimeout)
+		return
+	}
+
+	// 正在 Write 时连接并不空闲，不需要心跳
+	if time.Duration(now-c.lastSend.Load()) >= c.heartbeatInterval && c.writeMutex.TryLock() {
+		c.trace("send ping")
+		c.pending.Or(controlPing)
+		c.flushControl()
+		c.unlockWrite()
+	}
+}
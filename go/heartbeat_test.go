@@ -0,0 +1,88 @@
+package snet
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Heartbeat_Idle(t *testing.T) {
+	srvConfig := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+	cliConfig := srvConfig
+	cliConfig.HeartbeatInterval = 20 * time.Millisecond
+	cliConfig.HeartbeatTimeout = 100 * time.Millisecond
+
+	listener, conn, sconn := testConns(t, srvConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+	go io.Copy(sconn, sconn)
+
+	base := conn.baseForTest()
+	time.AfterFunc(500*time.Millisecond, func() {
+		conn.Write([]byte("hello"))
+	})
+
+	var buf [5]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if string(buf[:]) != "hello" {
+		t.Fatalf("buf = %q", buf[:])
+	}
+
+	if conn.baseForTest() != base {
+		t.Fatalf("idle conn reconnected")
+	}
+}
+
+// 吞掉所有写入的数据，模拟对方失联
+type muteConn struct {
+	net.Conn
+}
+
+func (c muteConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func Test_Heartbeat_DeadPeer(t *testing.T) {
+	srvConfig := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+	cliConfig := srvConfig
+	cliConfig.HeartbeatInterval = 20 * time.Millisecond
+	cliConfig.HeartbeatTimeout = 100 * time.Millisecond
+	cliConfig.ReconnectPolicy.InitialBackoff = 10 * time.Millisecond
+
+	listener, conn, sconn := testConns(t, srvConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+	sconn.WrapBaseForTest(func(base net.Conn) net.Conn {
+		return muteConn{base}
+	})
+	go io.Copy(sconn, sconn)
+
+	base := conn.baseForTest()
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if conn.baseForTest() != base {
+				conn.Write([]byte("hello"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Close()
+	}()
+
+	var buf [5]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if string(buf[:]) != "hello" {
+		t.Fatalf("buf = %q", buf[:])
+	}
+}
@@ -0,0 +1,20 @@
+package snet
+
+// Hooks 连接的生命周期回调，客户端和服务端的连接都会调用。
+// 回调在内部 goroutine 中同步执行，应尽快返回。
+// OnDisconnect、OnReconnecting、OnReconnected 可能在重连持有锁时调用，OnClosed 可能在 Read 或 Write 中调用，
+// 回调中不能调用这个连接的 Read、Write 和 TryReconn，也不能调用 Listener 的 Handoff，否则会死锁；
+// Close、RemoteAddr、LocalAddr、SetDeadline 系列和 SetReconnWaitTimeout 可以调用
+type Hooks struct {
+	// 底层连接断开时调用，err 为发现断线的原因，每次断线只调用一次
+	OnDisconnect func(c *Conn, err error)
+
+	// 客户端每次尝试重连时调用，attempt 从 1 开始
+	OnReconnecting func(c *Conn, attempt int)
+
+	// 重连成功时调用，rewrite 和 reread 为重传给对方和从对方重新接收的字节数
+	OnReconnected func(c *Conn, rewrite, reread int)
+
+	// 连接关闭时调用，err 为关闭的原因，调用 Close 主动关闭时为 nil
+	OnClosed func(c *Conn, err error)
+}
@@ -0,0 +1,136 @@
+package snet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hookRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *hookRecorder) add(format string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *hookRecorder) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnDisconnect: func(c *Conn, err error) {
+			r.add("disconnect")
+		},
+		OnReconnecting: func(c *Conn, attempt int) {
+			r.add("reconnecting %d", attempt)
+		},
+		OnReconnected: func(c *Conn, rewrite, reread int) {
+			r.add("reconnected %d %d", rewrite, reread)
+		},
+		OnClosed: func(c *Conn, err error) {
+			r.add("closed %v", err)
+		},
+	}
+}
+
+func Test_Hooks(t *testing.T) {
+	var cli, srv hookRecorder
+	srvConfig := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		Hooks:              srv.hooks(),
+	}
+	cliConfig := srvConfig
+	cliConfig.Hooks = cli.hooks()
+
+	listener, err := Listen(srvConfig, func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// 第一次重连失败
+	var dials int
+	conn, err := Dial(cliConfig, func() (net.Conn, error) {
+		dials++
+		if dials == 2 {
+			return nil, net.ErrClosed
+		}
+		return net.Dial("tcp", listener.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	conn.(*Conn).reconnPolicy.InitialBackoff = 10 * time.Millisecond
+
+	sconn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+
+	conn.(*Conn).baseForTest().Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	readHello(t, sconn.(*Conn))
+
+	conn.Close()
+	sconn.Close()
+
+	expect := []string{"disconnect", "reconnecting 1", "reconnecting 2", "reconnected 8 0", "closed <nil>"}
+	if events := cli.get(); !reflect.DeepEqual(events, expect) {
+		t.Fatalf("client events = %q, want %q", events, expect)
+	}
+
+	expect = []string{"disconnect", "reconnected 0 8", "closed <nil>"}
+	if events := srv.get(); !reflect.DeepEqual(events, expect) {
+		t.Fatalf("server events = %q, want %q", events, expect)
+	}
+}
+
+func Test_Hooks_Reentrant(t *testing.T) {
+	closed := make(chan error, 1)
+	config := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+	cliConfig := config
+	cliConfig.Hooks = Hooks{
+		OnReconnecting: func(c *Conn, attempt int) {
+			c.RemoteAddr()
+			c.LocalAddr()
+		},
+		OnClosed: func(c *Conn, err error) {
+			c.RemoteAddr()
+			c.Close()
+			closed <- err
+		},
+	}
+	listener, conn, sconn := testConns(t, config, cliConfig)
+	defer listener.Close()
+
+	// 服务端的会话已经关闭，重连被拒绝时在持有锁的 tryReconn 中关闭连接
+	sconn.Close()
+	conn.TryReconn()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, ErrUnknownSession) {
+			t.Fatalf("err = %v, want ErrUnknownSession", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hooks deadlocked")
+	}
+}
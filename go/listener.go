@@ -2,12 +2,12 @@ package snet
 
 import (
 	"bytes"
-	"crypto/md5"
+	"crypto/ecdh"
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"log/slog"
 	"net"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,38 +18,89 @@ import (
 var _ net.Listener = &Listener{}
 
 const (
-	TYPE_NEWCONN byte = 0x00
-	TYPE_RECONN  byte = 0xFF
+	TYPE_NEWCONN  byte = 0x00
+	TYPE_NEWCONN2 byte = 0x01
+	TYPE_RECONN3  byte = 0xFD
+	TYPE_RECONN2  byte = 0xFE
+	TYPE_RECONN   byte = 0xFF
 )
 
+const x25519KeySize = 32
+
 type Listener struct {
-	base         net.Listener
-	config       Config
-	acceptChan   chan net.Conn
-	closed       bool
-	closeOnce    sync.Once
-	closeChan    chan struct{}
-	atomicConnID uint64
-	connsMutex   sync.Mutex
-	conns        map[uint64]*Conn
+	base       net.Listener
+	config     Config
+	acceptChan chan net.Conn
+	closed     bool
+	closeOnce  sync.Once
+	closeChan  chan struct{}
+	connsMutex sync.Mutex
+	conns      map[uint64]*Conn
+	budget     *rewriterBudget
+	acceptDone chan struct{}
+	handshakes sync.WaitGroup
+	draining   atomic.Bool
+
+	// 正在握手的连接，值表示是否已经收到请求类型
+	pendingMutex sync.Mutex
+	pending      map[net.Conn]bool
+
+	handshakeSlots   chan struct{}
+	handshakeLimiter *rateLimiter
+	reconnLimiter    *rateLimiter
+	trustedPeers     map[string]bool
 }
 
 func Listen(config Config, listenFunc func() (net.Listener, error)) (*Listener, error) {
+	l, err := newListener(config, listenFunc)
+	if err != nil {
+		return nil, err
+	}
+	l.start()
+	return l, nil
+}
+
+func newListener(config Config, listenFunc func() (net.Listener, error)) (*Listener, error) {
 	listener, err := listenFunc()
 	if err != nil {
 		return nil, err
 	}
+	if config.AcceptBacklog <= 0 {
+		config.AcceptBacklog = 1000
+	}
+	// 限制握手数量时不能让不发送请求的连接一直占用名额
+	if config.MaxHandshakes > 0 && config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = 10 * time.Second
+	}
 	l := &Listener{
-		base:       listener,
-		config:     config,
-		closeChan:  make(chan struct{}),
-		acceptChan: make(chan net.Conn, 1000),
-		conns:      make(map[uint64]*Conn),
+		base:             listener,
+		config:           config,
+		closeChan:        make(chan struct{}),
+		acceptChan:       make(chan net.Conn, config.AcceptBacklog),
+		acceptDone:       make(chan struct{}),
+		conns:            make(map[uint64]*Conn),
+		pending:          make(map[net.Conn]bool),
+		budget:           newRewriterBudget(config.RewriterBudget),
+		handshakeLimiter: newRateLimiter(config.HandshakeRate, config.HandshakeBurst),
+		reconnLimiter:    newRateLimiter(config.ReconnectRate, config.ReconnectBurst),
+	}
+	if config.MaxHandshakes > 0 {
+		l.handshakeSlots = make(chan struct{}, config.MaxHandshakes)
+	}
+	if len(config.TrustedPeers) > 0 {
+		l.trustedPeers = make(map[string]bool, len(config.TrustedPeers))
+		for _, ip := range config.TrustedPeers {
+			l.trustedPeers[ip] = true
+		}
 	}
-	go l.acceptLoop()
 	return l, nil
 }
 
+func (l *Listener) start() {
+	go l.acceptLoop()
+	go l.reapLoop()
+}
+
 func (l *Listener) Addr() net.Addr {
 	return l.base.Addr()
 }
@@ -68,10 +119,11 @@ func (l *Listener) Accept() (net.Conn, error) {
 		return conn, nil
 	case <-l.closeChan:
 	}
-	return nil, os.ErrInvalid
+	return nil, net.ErrClosed
 }
 
 func (l *Listener) acceptLoop() {
+	defer close(l.acceptDone)
 	for {
 		conn, err := l.base.Accept()
 		if err != nil {
@@ -80,36 +132,86 @@ func (l *Listener) acceptLoop() {
 			}
 			break
 		}
-		go l.handAccept(conn)
+		// 在启动 goroutine 之前限制频率，被限制的 IP 不会占用任何资源
+		if !l.allow(l.handshakeLimiter, conn, time.Now()) {
+			l.dropHandshake(conn, "rate_limit")
+			continue
+		}
+		// 还没有发送请求类型的连接同样占用握手名额，不能靠大量空闲连接耗尽 goroutine
+		if !l.acquireHandshake() {
+			l.dropHandshake(conn, "concurrency")
+			continue
+		}
+		l.handshakes.Add(1)
+		l.setPending(conn, false)
+		go func() {
+			defer l.handshakes.Done()
+			defer l.deletePending(conn)
+			l.handAccept(conn)
+		}()
 	}
 }
 
+// 调用时已占用握手名额，重连在收到请求类型后释放
 func (l *Listener) handAccept(conn net.Conn) {
+	slot := true
+	defer func() {
+		if slot {
+			l.releaseHandshake()
+		}
+	}()
+
 	var buf [1]byte
 	if l.config.HandshakeTimeout > 0 {
 		conn.SetReadDeadline(time.Now().Add(l.config.HandshakeTimeout))
-		defer conn.SetReadDeadline(time.Time{})
 	}
 
 	if _, err := io.ReadFull(conn, buf[:]); err != nil {
 		conn.Close()
 		return
 	}
+	l.setPending(conn, true)
+
+	if l.draining.Load() && buf[0] != TYPE_RECONN && buf[0] != TYPE_RECONN2 && buf[0] != TYPE_RECONN3 {
+		l.trace("listener draining")
+		l.config.metrics().Handshake(false)
+		conn.Close()
+		return
+	}
+
+	// 只有新建连接的握手需要计算密钥，重连不占用握手的名额
+	if buf[0] == TYPE_NEWCONN || buf[0] == TYPE_NEWCONN2 {
+		if len(l.acceptChan) == cap(l.acceptChan) {
+			l.dropHandshake(conn, "backlog")
+			return
+		}
+	} else {
+		l.releaseHandshake()
+		slot = false
+	}
 
 	switch buf[0] {
 	case TYPE_NEWCONN:
-		l.handshake(conn)
-	case TYPE_RECONN:
-		l.reconn(conn)
+		if !l.config.LegacyHandshake || !l.config.acceptProof(PROOF_MD5) {
+			l.trace("legacy handshake disabled")
+			l.config.metrics().Handshake(false)
+			conn.Close()
+			return
+		}
+		l.config.metrics().Handshake(l.legacyHandshake(conn))
+	case TYPE_NEWCONN2:
+		l.config.metrics().Handshake(l.handshake(conn))
+	case TYPE_RECONN, TYPE_RECONN2, TYPE_RECONN3:
+		l.reconn(conn, buf[0])
 	default:
+		l.config.metrics().Handshake(false)
 		conn.Close()
 	}
 }
 
-func (l *Listener) handshake(conn net.Conn) {
+func (l *Listener) legacyHandshake(conn net.Conn) (ok bool) {
 	if l.config.HandshakeTimeout > 0 {
 		conn.SetDeadline(time.Now().Add(l.config.HandshakeTimeout))
-		defer conn.SetDeadline(time.Time{})
 	}
 
 	var (
@@ -124,7 +226,7 @@ func (l *Listener) handshake(conn net.Conn) {
 		return
 	}
 
-	l.trace("new conn")
+	l.trace("new legacy conn")
 	connPubKey := binary.LittleEndian.Uint64(field1)
 	if connPubKey == 0 {
 		l.trace("zero public key")
@@ -135,9 +237,11 @@ func (l *Listener) handshake(conn net.Conn) {
 	privKey, pubKey := dh64.KeyPair()
 	secret := dh64.Secret(privKey, connPubKey)
 
-	connID := atomic.AddUint64(&l.atomicConnID, 1)
-	sconn, err := newConn(conn, connID, secret, l.config)
-	if err != nil {
+	connID := l.newConnID()
+	sconn := l.newConn(conn, connID, legacyKey(secret))
+	sconn.proof = PROOF_MD5
+	sconn.legacy = true
+	if err := sconn.useLegacyCipher(); err != nil {
 		l.trace("new conn failed: %s", err)
 		conn.Close()
 		return
@@ -153,78 +257,322 @@ func (l *Listener) handshake(conn net.Conn) {
 		return
 	}
 
-	// 二次握手
+	return l.checkHandshake(sconn, field3)
+}
+
+func (l *Listener) handshake(conn net.Conn) (ok bool) {
+	if l.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(l.config.HandshakeTimeout))
+	}
+
+	var (
+		buf    [2 + x25519KeySize + 16]byte
+		field0 = buf[0:2]
+		field1 = buf[2 : 2+x25519KeySize]
+		field2 = buf[2+x25519KeySize : 10+x25519KeySize]
+		field3 = buf[10+x25519KeySize : 18+x25519KeySize]
+	)
+
+	// 协商加密套件
+	suite, err := l.selectSuite(conn)
+	if err != nil {
+		l.trace("select cipher suite failed: %s", err)
+		conn.Close()
+		return
+	}
+
+	// 协商验证算法
+	proof, err := l.selectProof(conn)
+	if err != nil {
+		l.trace("select proof version failed: %s", err)
+		conn.Close()
+		return
+	}
+
+	// 读取客户端公钥
+	if _, err := io.ReadFull(conn, field1); err != nil {
+		conn.Close()
+		return
+	}
+
+	l.trace("new conn")
+	connPubKey, err := ecdh.X25519().NewPublicKey(field1)
+	if err != nil {
+		l.trace("bad public key: %s", err)
+		conn.Close()
+		return
+	}
+
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		l.trace("generate key failed: %s", err)
+		conn.Close()
+		return
+	}
+
+	// 低阶点等非法公钥会在这里返回错误
+	secret, err := privKey.ECDH(connPubKey)
+	if err != nil {
+		l.trace("key exchange failed: %s", err)
+		conn.Close()
+		return
+	}
+
+	connID := l.newConnID()
+	sconn := l.newConn(conn, connID, nil)
+	sconn.proof = proof
+	salt := append(connPubKey.Bytes(), privKey.PublicKey().Bytes()...)
+	if err := sconn.useSuite(suite, secret, salt, false); err != nil {
+		l.trace("use cipher suite failed: %s", err)
+		conn.Close()
+		return
+	}
+
+	field0[0] = suite.ID()
+	field0[1] = proof
+	copy(field1, privKey.PublicKey().Bytes())
+	binary.LittleEndian.PutUint64(field2, connID)
+	if err := cryptConnID(field2, secret, salt); err != nil {
+		l.trace("crypt conn id failed: %s", err)
+		conn.Close()
+		return
+	}
+	rand.Read(field3)
+	if _, err := conn.Write(buf[:]); err != nil {
+		l.trace("send handshake response failed: %s", err)
+		conn.Close()
+		return
+	}
+
+	return l.checkHandshake(sconn, field3)
+}
+
+// 服务端连接的重传缓冲区共享扩容额度
+func (l *Listener) newConn(conn net.Conn, id uint64, key []byte) *Conn {
+	sconn := newConn(conn, id, key, l.config)
+	sconn.rewriter.budget = l.budget
+	return sconn
+}
+
+// 二次握手
+func (l *Listener) checkHandshake(sconn *Conn, challenge []byte) (ok bool) {
+	conn := sconn.base
+
 	l.trace("check twice handshake")
-	var buf2 [16]byte
+	var buf2 [proofSize]byte
 	if _, err := io.ReadFull(conn, buf2[:]); err != nil {
 		l.trace("read twice handshake failed: %s", err)
 		conn.Close()
 		return
 	}
 
-	hash := md5.New()
-	hash.Write(field3)
-	hash.Write(sconn.key[:])
-	md5sum := hash.Sum(nil)
-	if !bytes.Equal(buf2[:], md5sum) {
-		l.trace("twice handshake not equals: %x, %x", buf2[:], md5sum)
+	if !sconn.checkProof(challenge, buf2[:]) {
+		l.trace("twice handshake not equals: %x", buf2[:])
 		conn.Close()
 		return
 	}
 
+	// 握手超时在会话交给 Accept 之前清除，之后的超时由应用层设置
+	conn.SetDeadline(time.Time{})
+
+	// Shutdown 开始前已经在握手的连接，完成时同样拒绝
+	if !l.putNewConn(sconn.id, sconn) {
+		l.trace("listener draining")
+		conn.Close()
+		return false
+	}
 	sconn.listener = l
-	l.putConn(connID, sconn)
+	l.log(slog.LevelInfo, "new conn", "conn_id", sconn.id, "remote_addr", conn.RemoteAddr().String())
 	select {
 	case l.acceptChan <- sconn:
+		sconn.startHeartbeat()
+		sconn.startAck()
 	case <-l.closeChan:
+		sconn.Close()
+	default:
+		// 握手期间 backlog 被其它会话排满
+		l.dropHandshake(conn, "backlog")
+		sconn.Close()
+		return false
+	}
+	return true
+}
+
+func (l *Listener) acquireHandshake() bool {
+	if l.handshakeSlots == nil {
+		return true
+	}
+	select {
+	case l.handshakeSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) releaseHandshake() {
+	if l.handshakeSlots != nil {
+		<-l.handshakeSlots
+	}
+}
+
+func (l *Listener) setPending(conn net.Conn, typed bool) {
+	l.pendingMutex.Lock()
+	defer l.pendingMutex.Unlock()
+	l.pending[conn] = typed
+}
+
+func (l *Listener) deletePending(conn net.Conn) {
+	l.pendingMutex.Lock()
+	defer l.pendingMutex.Unlock()
+	delete(l.pending, conn)
+}
+
+// 关闭正在握手的连接，all 为 false 时只关闭还没有收到请求类型的连接
+func (l *Listener) closePending(all bool) {
+	l.pendingMutex.Lock()
+	defer l.pendingMutex.Unlock()
+	for conn, typed := range l.pending {
+		if all || !typed {
+			conn.Close()
+		}
+	}
+}
+
+// 因为握手限制直接关闭连接
+func (l *Listener) dropHandshake(conn net.Conn, reason string) {
+	l.trace("handshake dropped: %s", reason)
+	l.log(slog.LevelWarn, "handshake dropped", "reason", reason, "remote_addr", conn.RemoteAddr().String())
+	l.config.metrics().HandshakeDropped(reason)
+	conn.Close()
+}
+
+// 按服务端的优先级选择客户端支持的加密套件
+func (l *Listener) selectSuite(conn net.Conn) (CipherSuite, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+
+	ids := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, ids); err != nil {
+		return nil, err
+	}
+
+	for _, suite := range l.config.cipherSuites() {
+		if bytes.IndexByte(ids, suite.ID()) >= 0 {
+			return suite, nil
+		}
+	}
+	return nil, ErrNoCipherSuite
+}
+
+// 按服务端的优先级选择客户端支持的验证算法
+func (l *Listener) selectProof(conn net.Conn) (byte, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return 0, err
+	}
+
+	versions := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, versions); err != nil {
+		return 0, err
 	}
+
+	for _, version := range l.config.proofs() {
+		if makeProof(version, nil, nil) != nil && bytes.IndexByte(versions, version) >= 0 {
+			return version, nil
+		}
+	}
+	return 0, ErrNoProof
 }
 
 // 重连
-func (l *Listener) reconn(conn net.Conn) {
-	// 设置重连超时
+func (l *Listener) reconn(conn net.Conn, reconnType byte) {
+	// 设置重连超时，重连成功后 handleReconn 会换成用户设置的读写超时
 	if l.config.ReconnWaitTimeout > 0 {
 		conn.SetDeadline(time.Now().Add(l.config.ReconnWaitTimeout))
-		defer conn.SetDeadline(time.Time{})
 	}
 
+	// TYPE_RECONN3 的请求在收发字节数之后多了 8 个字节的序号
+	size := 24
+	if reconnType == TYPE_RECONN3 {
+		size = 32
+	}
 	var (
-		buf    [24 + md5.Size]byte
-		buf2   [24]byte
-		field1 = buf[0:8]
-		field2 = buf[8:16]
-		field3 = buf[16:24]
-		field4 = buf[24 : 24+md5.Size]
+		buf   [32 + proofSize]byte
+		req   = buf[:size+proofSize]
+		data  = req[:size]
+		proof = req[size:]
+		seq   uint64
 	)
-	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+	if _, err := io.ReadFull(conn, req); err != nil {
 		conn.Close()
 		return
 	}
+	if reconnType == TYPE_RECONN3 {
+		seq = binary.LittleEndian.Uint64(data[24:32])
+	}
 
 	l.trace("reconn")
-	connID := binary.LittleEndian.Uint64(field1)
+	l.config.metrics().ReconnectAttempt()
+	if l.closed {
+		l.trace("listener closed")
+		l.refuseReconn(conn, reconnType, RECONN_SHUTTING_DOWN)
+		return
+	}
+
+	now := time.Now()
+	if !l.allow(l.reconnLimiter, conn, now) {
+		l.trace("reconn rate limited")
+		l.refuseReconn(conn, reconnType, RECONN_TRY_LATER)
+		return
+	}
+
+	connID := binary.LittleEndian.Uint64(data[0:8])
 	sconn, exists := l.getConn(connID)
+	if l.draining.Load() {
+		l.trace("listener draining")
+		l.refuseReconn(conn, reconnType, RECONN_SHUTTING_DOWN)
+		// 客户端收到拒绝后不会再重连，验证通过时直接关闭会话，不用等到 ReconnWaitTimeout；
+		// 重放的旧请求序号不大于会话最近一次重连的序号，不能关闭会话
+		if exists && sconn.checkProof(data, proof) && sconn.acceptSeq(seq) {
+			sconn.closeWithError(ErrServerShutdown)
+		}
+		return
+	}
 	if !exists {
+		if l.routeReconn(conn, reconnType, req) {
+			return
+		}
 		l.trace("conn %d not exists", connID)
-		conn.Write(buf2[:])
-		conn.Close()
+		l.refuseReconn(conn, reconnType, RECONN_UNKNOWN_SESSION)
 		return
 	}
 
-	hash := md5.New()
-	hash.Write(buf[:24])
-	hash.Write(sconn.key[:])
-	md5sum := hash.Sum(nil)
-	if !bytes.Equal(field4, md5sum) {
-		l.trace("not equals: %x, %x", field4, md5sum)
-		conn.Write(buf2[:])
-		conn.Close()
+	if sconn.lockedOut(now) {
+		l.trace("conn %d locked out", connID)
+		l.refuseReconn(conn, reconnType, RECONN_TRY_LATER)
 		return
 	}
 
-	writeCount := binary.LittleEndian.Uint64(field2)
-	readCount := binary.LittleEndian.Uint64(field3)
-	sconn.handleReconn(conn, writeCount, readCount)
+	if !l.config.acceptProof(sconn.proof) || !sconn.checkProof(data, proof) {
+		l.trace("not equals: %x", proof)
+		l.reconnFailed(sconn)
+		l.refuseReconn(conn, reconnType, RECONN_AUTH_FAILED)
+		return
+	}
+
+	// 重放的请求可以通过验证，但序号不会大于会话最近一次重连的序号
+	if sconn.staleSeq(seq) {
+		l.trace("stale reconn request: %d", seq)
+		l.refuseReconn(conn, reconnType, RECONN_STALE_REQUEST)
+		return
+	}
+
+	writeCount := binary.LittleEndian.Uint64(data[8:16])
+	readCount := binary.LittleEndian.Uint64(data[16:24])
+	sconn.handleReconn(conn, reconnType, writeCount, readCount, seq)
 }
 
 func (l *Listener) getConn(id uint64) (*Conn, bool) {
@@ -238,6 +586,30 @@ func (l *Listener) putConn(id uint64, conn *Conn) {
 	l.connsMutex.Lock()
 	defer l.connsMutex.Unlock()
 	l.conns[id] = conn
+	l.config.metrics().SessionOpened()
+}
+
+// 与 Shutdown 检查会话数量互斥，Shutdown 开始后不再加入新的会话
+func (l *Listener) putNewConn(id uint64, conn *Conn) bool {
+	l.connsMutex.Lock()
+	defer l.connsMutex.Unlock()
+	if l.draining.Load() {
+		return false
+	}
+	l.conns[id] = conn
+	l.config.metrics().SessionOpened()
+	return true
+}
+
+// 返回当前所有会话
+func (l *Listener) allConns() []*Conn {
+	l.connsMutex.Lock()
+	defer l.connsMutex.Unlock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for _, conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	return conns
 }
 
 func (l *Listener) delConn(id uint64) {
@@ -245,5 +617,6 @@ func (l *Listener) delConn(id uint64) {
 	defer l.connsMutex.Unlock()
 	if _, exists := l.conns[id]; exists {
 		delete(l.conns, id)
+		l.config.metrics().SessionClosed()
 	}
 }
@@ -0,0 +1,53 @@
+package snet
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Logger 结构化日志接口，*slog.Logger 可以直接使用。
+// 重连过程的详细跟踪使用 slog.LevelDebug，断线、重连和关闭使用 slog.LevelInfo 及以上
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+func (l *Listener) log(level slog.Level, msg string, args ...any) {
+	logger := l.config.Logger
+	if logger == nil || !logger.Enabled(context.Background(), level) {
+		return
+	}
+	args = append(args, "local_addr", l.base.Addr().String())
+	logger.Log(context.Background(), level, msg, args...)
+}
+
+func (l *Listener) trace(format string, args ...any) {
+	if logger := l.config.Logger; logger != nil && logger.Enabled(context.Background(), slog.LevelDebug) {
+		l.log(slog.LevelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// 日志可能在任意 goroutine 中输出，这里只附带不会变化的字段，收发字节数等由调用者在持有锁时传入
+func (c *Conn) log(level slog.Level, msg string, args ...any) {
+	if c.logger == nil || !c.logger.Enabled(context.Background(), level) {
+		return
+	}
+	side := "client"
+	if c.listener != nil {
+		side = "server"
+	}
+	args = append(args, "conn_id", c.id, "side", side)
+	c.logger.Log(context.Background(), level, msg, args...)
+}
+
+// Read 和 Write 中带参数的跟踪先用 tracing 判断，没有 Logger 时不为可变参数分配内存
+func (c *Conn) tracing() bool {
+	return c.logger != nil && c.logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+func (c *Conn) trace(format string, args ...any) {
+	if c.tracing() {
+		c.log(slog.LevelDebug, fmt.Sprintf(format, args...))
+	}
+}
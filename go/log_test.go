@@ -0,0 +1,60 @@
+package snet
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func Test_Logger(t *testing.T) {
+	var out syncBuffer
+	config := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		Logger:             slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	conn.baseForTest().Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	readHello(t, sconn)
+
+	logs := out.String()
+	for _, expect := range []string{
+		`"msg":"new conn"`,
+		`"msg":"base conn lost"`,
+		`"msg":"reconnected"`,
+		`"rewrite":8,`,
+		`"side":"server"`,
+		`"level":"DEBUG"`,
+	} {
+		if !strings.Contains(logs, expect) {
+			t.Fatalf("%s not found in logs:\n%s", expect, logs)
+		}
+	}
+}
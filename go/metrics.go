@@ -0,0 +1,202 @@
+package snet
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics 统计握手、重连和会话数量，实现需要支持并发调用。
+// Config.Metrics 为空时不做统计，MemoryMetrics 是内置的实现
+type Metrics interface {
+	// 服务端和客户端完成或放弃一次新建连接的握手
+	Handshake(accepted bool)
+
+	// 服务端因为 MaxHandshakes、HandshakeRate 或 AcceptBacklog 的限制丢弃新连接，
+	// reason 为 "concurrency"、"rate_limit" 或 "backlog"
+	HandshakeDropped(reason string)
+
+	// 客户端发起或服务端收到一次重连请求
+	ReconnectAttempt()
+
+	// 重连成功，latency 为发现断线到重连成功的时间，rewrite 和 reread 为重传的字节数
+	Reconnected(latency time.Duration, rewrite, reread int)
+
+	// 重连被拒绝，reason 为 RECONN_* 状态码对应的名称
+	ReconnectRefused(reason string)
+
+	// 需要重传的数据超出了重传缓冲区，开启确认时对方未确认的数据被覆盖也会统计
+	RewriterOverflow()
+
+	// 服务端会话的创建和关闭
+	SessionOpened()
+	SessionClosed()
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Handshake(bool)                      {}
+func (noopMetrics) HandshakeDropped(string)             {}
+func (noopMetrics) ReconnectAttempt()                   {}
+func (noopMetrics) Reconnected(time.Duration, int, int) {}
+func (noopMetrics) ReconnectRefused(string)             {}
+func (noopMetrics) RewriterOverflow()                   {}
+func (noopMetrics) SessionOpened()                      {}
+func (noopMetrics) SessionClosed()                      {}
+
+func (config *Config) metrics() Metrics {
+	if config.Metrics == nil {
+		return noopMetrics{}
+	}
+	return config.Metrics
+}
+
+// 状态码在统计中的名称，旧版协议的拒绝没有状态码
+func refuseReason(code byte) string {
+	switch code {
+	case RECONN_UNKNOWN_SESSION:
+		return "unknown_session"
+	case RECONN_AUTH_FAILED:
+		return "auth_failed"
+	case RECONN_BUFFER_OVERRUN:
+		return "buffer_overrun"
+	case RECONN_SHUTTING_DOWN:
+		return "shutting_down"
+	case RECONN_SESSION_MIGRATED:
+		return "session_migrated"
+	case RECONN_STALE_REQUEST:
+		return "stale_request"
+	case RECONN_TRY_LATER:
+		return "try_later"
+	}
+	return "refused"
+}
+
+// 重连耗时直方图的默认上界，单位为秒
+var LatencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// MemoryMetrics 在内存中累计的统计数据，零值可用，通过 Snapshot 读取
+type MemoryMetrics struct {
+	mutex    sync.Mutex
+	snapshot MetricsSnapshot
+}
+
+// MetricsSnapshot 某一时刻的统计数据
+type MetricsSnapshot struct {
+	HandshakesAccepted uint64
+	HandshakesFailed   uint64
+	HandshakeDrops     map[string]uint64
+	ReconnectAttempts  uint64
+	ReconnectSuccesses uint64
+	ReconnectRefusals  map[string]uint64
+	BytesRewritten     uint64
+	BytesReread        uint64
+	RewriterOverflows  uint64
+	Sessions           int64
+	ReconnectLatency   Histogram
+}
+
+// Histogram 累计直方图，Counts[i] 为不超过 Buckets[i] 秒的次数
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{}
+}
+
+func (m *MemoryMetrics) Handshake(accepted bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if accepted {
+		m.snapshot.HandshakesAccepted++
+	} else {
+		m.snapshot.HandshakesFailed++
+	}
+}
+
+func (m *MemoryMetrics) HandshakeDropped(reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.snapshot.HandshakeDrops == nil {
+		m.snapshot.HandshakeDrops = make(map[string]uint64)
+	}
+	m.snapshot.HandshakeDrops[reason]++
+}
+
+func (m *MemoryMetrics) ReconnectAttempt() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot.ReconnectAttempts++
+}
+
+func (m *MemoryMetrics) Reconnected(latency time.Duration, rewrite, reread int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot.ReconnectSuccesses++
+	m.snapshot.BytesRewritten += uint64(rewrite)
+	m.snapshot.BytesReread += uint64(reread)
+
+	h := &m.snapshot.ReconnectLatency
+	if h.Buckets == nil {
+		h.Buckets = LatencyBuckets
+		h.Counts = make([]uint64, len(LatencyBuckets))
+	}
+	seconds := latency.Seconds()
+	for i, bound := range h.Buckets {
+		if seconds <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += seconds
+}
+
+func (m *MemoryMetrics) ReconnectRefused(reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.snapshot.ReconnectRefusals == nil {
+		m.snapshot.ReconnectRefusals = make(map[string]uint64)
+	}
+	m.snapshot.ReconnectRefusals[reason]++
+}
+
+func (m *MemoryMetrics) RewriterOverflow() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot.RewriterOverflows++
+}
+
+func (m *MemoryMetrics) SessionOpened() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot.Sessions++
+}
+
+func (m *MemoryMetrics) SessionClosed() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot.Sessions--
+}
+
+func (m *MemoryMetrics) Snapshot() MetricsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.snapshot
+	s.HandshakeDrops = make(map[string]uint64, len(m.snapshot.HandshakeDrops))
+	for reason, n := range m.snapshot.HandshakeDrops {
+		s.HandshakeDrops[reason] = n
+	}
+	s.ReconnectRefusals = make(map[string]uint64, len(m.snapshot.ReconnectRefusals))
+	for reason, n := range m.snapshot.ReconnectRefusals {
+		s.ReconnectRefusals[reason] = n
+	}
+	if s.ReconnectLatency.Buckets == nil {
+		s.ReconnectLatency.Buckets = LatencyBuckets
+	}
+	s.ReconnectLatency.Counts = make([]uint64, len(s.ReconnectLatency.Buckets))
+	copy(s.ReconnectLatency.Counts, m.snapshot.ReconnectLatency.Counts)
+	return s
+}
@@ -0,0 +1,44 @@
+package snet
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_Metrics(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	config := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+		Metrics:            metrics,
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	conn.baseForTest().Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	readHello(t, sconn)
+
+	s := metrics.Snapshot()
+	if s.HandshakesAccepted != 2 || s.ReconnectAttempts != 2 || s.ReconnectSuccesses != 2 ||
+		s.BytesRewritten != 8 || s.BytesReread != 8 || s.Sessions != 1 || s.ReconnectLatency.Count != 2 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+
+	// 服务端会话关闭后重连被拒绝
+	sconn.Close()
+	conn.baseForTest().Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("err = %v, want ErrUnknownSession", err)
+	}
+
+	s = metrics.Snapshot()
+	if s.ReconnectRefusals["unknown_session"] != 2 || s.Sessions != 0 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+}
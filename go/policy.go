@@ -0,0 +1,72 @@
+package snet
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+var ErrReconnGaveUp = subError("snet: reconnect gave up", ErrReconnectTimeout)
+
+// ReconnectPolicy 客户端断线后的重连策略。
+// 第一次重连立即进行，之后每次等待的时间从 InitialBackoff 开始按 Multiplier 增长，不超过 MaxBackoff，
+// 并随机减少最多 Jitter 比例的时间，避免大量客户端在同一时刻重连。
+// 零值与旧版行为一致：每隔 3 秒重试一次，直到连接被关闭。
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+
+	// 最多尝试的次数和最长的重连时间，为 0 时不限制
+	MaxAttempts int
+	MaxDuration time.Duration
+
+	// 每次重试前调用，返回 false 时放弃重连，lastErr 为上一次尝试失败的原因
+	ShouldRetry func(attempt int, lastErr error) bool
+
+	// 每次尝试开始时调用，attempt 从 1 开始，第一次尝试时 lastErr 为 nil
+	OnAttempt func(attempt int, lastErr error)
+}
+
+// 不超过 math.MaxInt64 的最大的 float64，转换成 time.Duration 时不会溢出
+var maxBackoff = math.Nextafter(math.MaxInt64, 0)
+
+// 第 attempt 次尝试前需要等待的时间
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	if attempt <= 1 {
+		return 0
+	}
+
+	d := float64(p.InitialBackoff)
+	if d <= 0 {
+		d = float64(3 * time.Second)
+	}
+
+	// MaxBackoff 为 0 时也不能超出 time.Duration 的范围
+	limit := maxBackoff
+	if p.MaxBackoff > 0 {
+		limit = float64(p.MaxBackoff)
+	}
+	for i := 2; i < attempt && p.Multiplier > 1 && d < limit; i++ {
+		d *= p.Multiplier
+	}
+	d = min(d, limit)
+
+	if p.Jitter > 0 {
+		d -= d * min(p.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+func (p *ReconnectPolicy) giveUp(attempt int, elapsed time.Duration, lastErr error) bool {
+	switch {
+	case p.MaxAttempts > 0 && attempt > p.MaxAttempts:
+		return true
+	case p.MaxDuration > 0 && elapsed >= p.MaxDuration:
+		return true
+	case p.ShouldRetry != nil && !p.ShouldRetry(attempt, lastErr):
+		return true
+	}
+	return false
+}
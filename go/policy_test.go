@@ -0,0 +1,95 @@
+package snet
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Policy_Backoff(t *testing.T) {
+	var p ReconnectPolicy
+	if d := p.backoff(1); d != 0 {
+		t.Fatalf("first attempt should not wait, d = %s", d)
+	}
+	if d := p.backoff(5); d != 3*time.Second {
+		t.Fatalf("zero policy should wait 3s, d = %s", d)
+	}
+
+	p = ReconnectPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	expects := []time.Duration{0, 100, 200, 400, 800, 1000, 1000}
+	for i, expect := range expects {
+		if d := p.backoff(i + 1); d != expect*time.Millisecond {
+			t.Fatalf("attempt %d, d = %s, expect %dms", i+1, d, expect)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 1000; i++ {
+		if d := p.backoff(3); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("jitter out of range, d = %s", d)
+		}
+	}
+
+	// 不限制 MaxBackoff 时增长到 time.Duration 的上限为止
+	p = ReconnectPolicy{InitialBackoff: time.Second, Multiplier: 2}
+	for _, attempt := range []int{40, 100, 10000} {
+		if d := p.backoff(attempt); d != time.Duration(maxBackoff) {
+			t.Fatalf("attempt %d overflowed, d = %s", attempt, d)
+		}
+	}
+}
+
+func Test_Policy_GiveUp(t *testing.T) {
+	p := ReconnectPolicy{MaxAttempts: 3}
+	if p.giveUp(3, 0, nil) || !p.giveUp(4, 0, nil) {
+		t.Fatalf("MaxAttempts not respected")
+	}
+
+	p = ReconnectPolicy{MaxDuration: time.Second}
+	if p.giveUp(2, time.Second/2, nil) || !p.giveUp(2, time.Second, nil) {
+		t.Fatalf("MaxDuration not respected")
+	}
+
+	veto := errors.New("veto")
+	p = ReconnectPolicy{ShouldRetry: func(attempt int, lastErr error) bool {
+		return lastErr != veto
+	}}
+	if p.giveUp(2, 0, io.EOF) || !p.giveUp(2, 0, veto) {
+		t.Fatalf("ShouldRetry not respected")
+	}
+}
+
+func Test_Policy_MaxAttempts(t *testing.T) {
+	var attempts int32
+	config := suitesConfig(AES128GCMSuite)
+	config.ReconnectPolicy = ReconnectPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxAttempts:    3,
+		OnAttempt: func(attempt int, lastErr error) {
+			if attempt > 1 && lastErr == nil {
+				t.Errorf("attempt %d without last error", attempt)
+			}
+			atomic.AddInt32(&attempts, 1)
+		},
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer conn.Close()
+
+	listener.Close()
+	sconn.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrReconnGaveUp) {
+		t.Fatalf("err = %v, want ErrReconnGaveUp", err)
+	}
+
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("attempts = %d", n)
+	}
+}
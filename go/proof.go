@@ -0,0 +1,61 @@
+package snet
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+)
+
+// 握手和重连过程中用于验证身份的算法版本
+const (
+	PROOF_MD5         byte = 0x01
+	PROOF_HMAC_SHA256 byte = 0x02
+)
+
+// 验证码在线路上占用的字节数，HMAC-SHA256 截断到这个长度
+const proofSize = 16
+
+var ErrNoProof = subError("snet: no proof version in common", ErrHandshakeFailed)
+
+var defaultProofs = []byte{PROOF_HMAC_SHA256, PROOF_MD5}
+
+func (config *Config) proofs() []byte {
+	if len(config.Proofs) != 0 {
+		return config.Proofs
+	}
+	return defaultProofs
+}
+
+func (config *Config) acceptProof(version byte) bool {
+	for _, v := range config.proofs() {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// 旧版的 MD5 直接拼接数据和密钥，新版使用 HMAC
+func makeProof(version byte, key []byte, data []byte) []byte {
+	switch version {
+	case PROOF_MD5:
+		hash := md5.New()
+		hash.Write(data)
+		hash.Write(key)
+		return hash.Sum(nil)
+	case PROOF_HMAC_SHA256:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return mac.Sum(nil)[:proofSize]
+	}
+	return nil
+}
+
+func (c *Conn) makeProof(data []byte) []byte {
+	return makeProof(c.proof, c.key, data)
+}
+
+func (c *Conn) checkProof(data, sum []byte) bool {
+	expect := c.makeProof(data)
+	return expect != nil && hmac.Equal(expect, sum)
+}
@@ -0,0 +1,74 @@
+package snet
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+)
+
+func Test_Proof(t *testing.T) {
+	key := []byte("key")
+	data := []byte("challenge")
+
+	sum := md5.Sum([]byte("challengekey"))
+	if !bytes.Equal(makeProof(PROOF_MD5, key, data), sum[:]) {
+		t.Fatalf("md5 proof not compatible")
+	}
+
+	proof := makeProof(PROOF_HMAC_SHA256, key, data)
+	if len(proof) != proofSize {
+		t.Fatalf("hmac proof size = %d", len(proof))
+	}
+
+	if makeProof(0xEE, key, data) != nil {
+		t.Fatalf("unknown proof version")
+	}
+}
+
+func Test_Proof_MD5(t *testing.T) {
+	config := suitesConfig(AES128GCMSuite)
+	config.Proofs = []byte{PROOF_MD5}
+	ConfigConnTest(t, config, config, false, true)
+}
+
+func Test_Proof_Negotiate(t *testing.T) {
+	srvConfig := suitesConfig(AES128GCMSuite)
+	cliConfig := suitesConfig(AES128GCMSuite)
+	cliConfig.Proofs = []byte{PROOF_MD5, PROOF_HMAC_SHA256}
+	ConfigConnTest(t, srvConfig, cliConfig, false, true)
+}
+
+func proofDialTest(t *testing.T, srvConfig, cliConfig Config) error {
+	listener := testListen(t, srvConfig)
+	defer listener.Close()
+
+	conn, err := testDial(listener, cliConfig)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func Test_Proof_Mismatch(t *testing.T) {
+	srvConfig := suitesConfig(AES128GCMSuite)
+	srvConfig.Proofs = []byte{PROOF_HMAC_SHA256}
+	cliConfig := suitesConfig(AES128GCMSuite)
+	cliConfig.Proofs = []byte{PROOF_MD5}
+	if proofDialTest(t, srvConfig, cliConfig) == nil {
+		t.Fatalf("dial should fail without common proof version")
+	}
+}
+
+func Test_Proof_RefuseLegacy(t *testing.T) {
+	srvConfig := suitesConfig(AES128GCMSuite)
+	srvConfig.LegacyHandshake = true
+	cliConfig := srvConfig
+	if err := proofDialTest(t, srvConfig, cliConfig); err != nil {
+		t.Fatalf("legacy dial failed: %s", err)
+	}
+
+	srvConfig.Proofs = []byte{PROOF_HMAC_SHA256}
+	if proofDialTest(t, srvConfig, cliConfig) == nil {
+		t.Fatalf("legacy handshake should be refused without PROOF_MD5")
+	}
+}
@@ -0,0 +1,85 @@
+package snet
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// 按来源 IP 限制频率的令牌桶，rate 为每秒补充的令牌数，burst 为桶的容量
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rate 不大于 0 时不限制，burst 不大于 0 时为 rate 取整，至少为 1
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(int(rate), 1)
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	if r == nil {
+		return true
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, exists := r.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*r.rate, r.burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 删除已经补满的桶，避免记录过的 IP 一直占用内存
+func (r *rateLimiter) purge(now time.Time) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// 来自 TrustedPeers 的连接不限制频率
+func (l *Listener) allow(r *rateLimiter, conn net.Conn, now time.Time) bool {
+	ip := remoteIP(conn)
+	return l.trustedPeers[ip] || r.allow(ip, now)
+}
+
+// 限制频率时使用的来源 IP
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
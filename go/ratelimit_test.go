@@ -0,0 +1,175 @@
+package snet
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	r := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !r.allow("a", now) {
+			t.Fatalf("burst %d refused", i)
+		}
+	}
+	if r.allow("a", now) {
+		t.Fatalf("allowed beyond burst")
+	}
+	if !r.allow("b", now) {
+		t.Fatalf("other key refused")
+	}
+	if !r.allow("a", now.Add(500*time.Millisecond)) || r.allow("a", now.Add(500*time.Millisecond)) {
+		t.Fatalf("refill mismatch")
+	}
+
+	r.purge(now.Add(time.Second))
+	if len(r.buckets) != 1 {
+		t.Fatalf("buckets = %d", len(r.buckets))
+	}
+	r.purge(now.Add(2 * time.Second))
+	if len(r.buckets) != 0 {
+		t.Fatalf("buckets = %d", len(r.buckets))
+	}
+}
+
+func limitListener(t *testing.T, config Config) (*Listener, *MemoryMetrics, func() error) {
+	metrics := NewMemoryMetrics()
+	config.Metrics = metrics
+	listener, err := Listen(config, func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	dial := func() error {
+		conn, err := Dial(Config{}, func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	return listener, metrics, dial
+}
+
+func Test_Limit_MaxHandshakes(t *testing.T) {
+	listener, metrics, dial := limitListener(t, Config{MaxHandshakes: 1})
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// 不发送任何数据的连接同样占用名额
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := dial(); err == nil {
+		t.Fatalf("handshake accepted beyond MaxHandshakes")
+	}
+	idle.Close()
+	waitHandshakeSlot(t, listener, dial)
+
+	// 只发送握手类型的连接占住唯一的名额
+	stall, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	if _, err := stall.Write([]byte{TYPE_NEWCONN2}); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	drops := metrics.Snapshot().HandshakeDrops["concurrency"]
+	if err := dial(); err == nil {
+		t.Fatalf("handshake accepted beyond MaxHandshakes")
+	}
+	if n := metrics.Snapshot().HandshakeDrops["concurrency"] - drops; n != 1 {
+		t.Fatalf("drops = %d", n)
+	}
+	stall.Close()
+	waitHandshakeSlot(t, listener, dial)
+}
+
+// 占用名额的连接关闭后握手重新成功
+func waitHandshakeSlot(t *testing.T, listener *Listener, dial func() error) {
+	for i := 0; dial() != nil; i++ {
+		if i == 100 {
+			t.Fatalf("handshake slot not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := listener.Accept(); err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+}
+
+func Test_Limit_MaxHandshakes_Reconn(t *testing.T) {
+	config := Config{MaxHandshakes: 1, RewriterBufferSize: 1024, ReconnWaitTimeout: time.Minute}
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 发送了重连类型后停住的连接不再占用名额
+	stall, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer stall.Close()
+	if _, err := stall.Write([]byte{TYPE_RECONN3}); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	go io.Copy(sconn, sconn)
+	conn.baseForTest().Close()
+	echoCheck(t, conn)
+}
+
+func Test_Limit_HandshakeRate(t *testing.T) {
+	listener, metrics, dial := limitListener(t, Config{HandshakeRate: 0.1, HandshakeBurst: 2})
+	defer listener.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := dial(); err != nil {
+			t.Fatalf("dial failed: %s", err)
+		}
+		if _, err := listener.Accept(); err != nil {
+			t.Fatalf("accept failed: %s", err)
+		}
+	}
+	if err := dial(); err == nil {
+		t.Fatalf("handshake accepted beyond HandshakeBurst")
+	}
+	if n := metrics.Snapshot().HandshakeDrops["rate_limit"]; n != 1 {
+		t.Fatalf("drops = %d", n)
+	}
+}
+
+func Test_Limit_AcceptBacklog(t *testing.T) {
+	listener, metrics, dial := limitListener(t, Config{AcceptBacklog: 1})
+	defer listener.Close()
+
+	if err := dial(); err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	// 客户端握手完成时服务端可能还没有把会话放进 backlog
+	for len(listener.acceptChan) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := dial(); err == nil {
+		t.Fatalf("handshake accepted beyond AcceptBacklog")
+	}
+	if n := metrics.Snapshot().HandshakeDrops["backlog"]; n != 1 {
+		t.Fatalf("drops = %d", n)
+	}
+
+	if _, err := listener.Accept(); err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+}
@@ -0,0 +1,126 @@
+package snet
+
+import (
+	"log/slog"
+	"time"
+)
+
+var ErrSessionExpired = subError("snet: session expired while waiting for reconnect", ErrReconnectTimeout)
+
+// 记录底层连接断开的时间，服务端据此回收长时间没有重连的会话
+func (c *Conn) lost(err error) {
+	select {
+	case <-c.closeChan:
+		return
+	default:
+	}
+
+	if !c.lostAt.CompareAndSwap(0, time.Now().UnixNano()) {
+		return
+	}
+	c.log(slog.LevelInfo, "base conn lost", "err", err)
+	if c.hooks.OnDisconnect != nil {
+		c.hooks.OnDisconnect(c, err)
+	}
+}
+
+func (c *Conn) expired(now time.Time) bool {
+	lostAt := c.lostAt.Load()
+	return lostAt != 0 && now.Sub(time.Unix(0, lostAt)) > c.reconnWait()
+}
+
+// 扫描间隔为 ReconnWaitTimeout 的一半，在 10ms 到 1s 之间
+func (l *Listener) reapInterval() time.Duration {
+	return min(max(l.config.ReconnWaitTimeout/2, 10*time.Millisecond), time.Second)
+}
+
+// 应用层没有调用 Read 或 Write 时 waitReconn 不会超时，断线的会话由 reapLoop 关闭，
+// 避免被遗弃的会话和它的重传缓冲区一直留在 conns 中
+func (l *Listener) reapLoop() {
+	ticker := time.NewTicker(l.reapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.reap(now)
+		case <-l.closeChan:
+			return
+		}
+	}
+}
+
+func (l *Listener) reap(now time.Time) {
+	l.handshakeLimiter.purge(now)
+	l.reconnLimiter.purge(now)
+
+	var expired []*Conn
+	l.connsMutex.Lock()
+	for _, conn := range l.conns {
+		if conn.expired(now) {
+			expired = append(expired, conn)
+		} else {
+			conn.shrinkRewriter(now)
+		}
+	}
+	l.connsMutex.Unlock()
+
+	for _, conn := range expired {
+		l.trace("session %d expired", conn.id)
+		conn.closeWithError(ErrSessionExpired)
+	}
+}
+
+// 客户端没有 reapLoop，由自己的 goroutine 定时缩小重传缓冲区
+func (c *Conn) startShrink() {
+	if c.rewriter.max > c.rewriter.min {
+		go c.shrinkLoop()
+	}
+}
+
+func (c *Conn) shrinkLoop() {
+	ticker := time.NewTicker(min(max(c.rewriterIdle/2, 10*time.Millisecond), time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.shrinkRewriter(now)
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+// 写入空闲或对方已确认全部数据的连接缩小重传缓冲区，正在读写或重连时跳过，下次扫描再处理。
+// 断线期间不缩小，对方未确认的数据重连时还需要重传
+func (c *Conn) shrinkRewriter(now time.Time) {
+	idle := time.Duration(now.UnixNano()-c.lastSend.Load()) >= c.rewriterIdle
+	if !idle && c.peerAcked.Load() == 0 || c.lostAt.Load() != 0 {
+		return
+	}
+
+	if !c.writeMutex.TryLock() {
+		return
+	}
+	defer c.unlockWrite()
+
+	if !c.reconnMutex.TryRLock() {
+		return
+	}
+	defer c.reconnMutex.RUnlock()
+
+	if c.lostAt.Load() != 0 {
+		return
+	}
+	unacked := c.unacked()
+	if idle || unacked == 0 {
+		c.rewriter.trim(unacked)
+		c.rewriter.shrink(int(min(unacked, uint64(c.rewriter.Buffered()))))
+	}
+}
+
+// 关闭后等待正在进行的 Write 结束，再归还扩容额度并删除临时文件
+func (c *Conn) releaseRewriter() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.rewriter.release()
+}
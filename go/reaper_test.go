@@ -0,0 +1,80 @@
+package snet
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Reaper(t *testing.T) {
+	srvConfig := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  200 * time.Millisecond,
+		HeartbeatInterval:  20 * time.Millisecond,
+	}
+	cliConfig := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+
+	listener, conn, sconn := testConns(t, srvConfig, cliConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 客户端断线后不再重连，服务端也没有调用 Read 或 Write，只能靠心跳发现断线
+	conn.baseForTest().Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exists := listener.getConn(sconn.id); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session not reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := sconn.Read(make([]byte, 1)); err != ErrSessionExpired {
+		t.Fatalf("err = %v, want ErrSessionExpired", err)
+	}
+}
+
+func Test_Reaper_Reconnected(t *testing.T) {
+	config := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  200 * time.Millisecond,
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	sconn.lost(nil)
+	sconn.doReconn(sconn.baseForTest(), 0, 0)
+	listener.reap(time.Now().Add(time.Minute))
+	if _, exists := listener.getConn(sconn.id); !exists {
+		t.Fatalf("reconnected session reaped")
+	}
+
+	sconn.lost(nil)
+	listener.reap(time.Now().Add(time.Minute))
+	if _, exists := listener.getConn(sconn.id); exists {
+		t.Fatalf("lost session not reaped")
+	}
+}
+
+func Test_Reaper_SetReconnWaitTimeout(t *testing.T) {
+	config := Config{
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  20 * time.Millisecond,
+	}
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 与 reapLoop 并发修改，-race 下不能报告数据竞争
+	for i := 0; i < 10; i++ {
+		sconn.SetReconnWaitTimeout(time.Minute)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
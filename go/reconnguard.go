@@ -0,0 +1,69 @@
+package snet
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"time"
+)
+
+// 生成一次重连尝试的请求，新版握手的连接每次尝试使用递增的序号，服务端拒绝不大于上次序号的请求
+func (c *Conn) reconnRequest() []byte {
+	size := 32
+	if c.legacy {
+		size = 24
+	}
+	req := make([]byte, 1+size+proofSize)
+	binary.LittleEndian.PutUint64(req[1:9], c.id)
+	binary.LittleEndian.PutUint64(req[9:17], c.writeCount)
+	binary.LittleEndian.PutUint64(req[17:25], c.readCount)
+	if c.legacy {
+		req[0] = TYPE_RECONN
+	} else {
+		req[0] = TYPE_RECONN3
+		binary.LittleEndian.PutUint64(req[25:33], c.reconnSeq.Add(1))
+	}
+	copy(req[1+size:], c.makeProof(req[1:1+size]))
+	return req
+}
+
+// 序号为 0 的是不带序号的旧版请求，会话收到过带序号的请求后不再接受
+func (c *Conn) staleSeq(seq uint64) bool {
+	last := c.reconnSeq.Load()
+	return seq <= last && !(seq == 0 && last == 0)
+}
+
+// 验证通过后记录请求的序号，并发的请求中序号较小的返回 false
+func (c *Conn) acceptSeq(seq uint64) bool {
+	for {
+		last := c.reconnSeq.Load()
+		if seq == 0 && last == 0 {
+			return true
+		}
+		if seq <= last {
+			return false
+		}
+		if c.reconnSeq.CompareAndSwap(last, seq) {
+			return true
+		}
+	}
+}
+
+func (c *Conn) lockedOut(now time.Time) bool {
+	return now.UnixNano() < c.lockedUntil.Load()
+}
+
+// 记录一次验证失败，连续失败 MaxReconnectFailures 次后锁定会话的重连
+func (l *Listener) reconnFailed(c *Conn) {
+	limit := l.config.MaxReconnectFailures
+	if limit <= 0 || c.reconnFailures.Add(1) < int32(limit) {
+		return
+	}
+
+	lockout := l.config.ReconnectLockout
+	if lockout == 0 {
+		lockout = 10 * time.Second
+	}
+	c.reconnFailures.Store(0)
+	c.lockedUntil.Store(time.Now().Add(lockout).UnixNano())
+	l.log(slog.LevelWarn, "reconnect locked out", "conn_id", c.id, "lockout", lockout)
+}
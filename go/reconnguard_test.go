@@ -0,0 +1,201 @@
+package snet
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 直接发送重连请求，返回响应的状态码
+func rawReconn(t *testing.T, addr string, req []byte) byte {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	var buf [25]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	return buf[0]
+}
+
+var guardConfig = Config{
+	EnableCrypt:        true,
+	RewriterBufferSize: 1024,
+	ReconnWaitTimeout:  time.Minute,
+	ReconnectPolicy:    ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+}
+
+// 发送重连请求并完成挑战验证，返回响应的状态码
+func provenReconn(t *testing.T, addr string, c *Conn, req []byte) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	var buf [25]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if buf[0] == RECONN_OK {
+		if _, err := conn.Write(c.makeProof(buf[17:25])); err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+	}
+	return conn, buf[0]
+}
+
+func Test_Reconn_Replay(t *testing.T) {
+	listener, conn, sconn := testConns(t, guardConfig, guardConfig)
+	defer listener.Close()
+	defer conn.Close()
+	addr := listener.Addr().String()
+
+	// 抢先重放的请求无法通过挑战验证，不会用掉序号
+	req := conn.reconnRequest()
+	if code := rawReconn(t, addr, req); code != RECONN_OK {
+		t.Fatalf("code = %d", code)
+	}
+	raw, code := provenReconn(t, addr, conn, req)
+	if code != RECONN_OK {
+		t.Fatalf("proven code = %d", code)
+	}
+	for sconn.reconnSeq.Load() < binary.LittleEndian.Uint64(req[25:33]) {
+		time.Sleep(time.Millisecond)
+	}
+	raw.Close()
+	if code := rawReconn(t, addr, req); code != RECONN_STALE_REQUEST {
+		t.Fatalf("replay code = %d", code)
+	}
+
+	// 收到过带序号的请求后不再接受旧版请求
+	old := append([]byte{TYPE_RECONN2}, req[1:25]...)
+	old = append(old, conn.makeProof(old[1:25])...)
+	if code := rawReconn(t, addr, old); code != RECONN_STALE_REQUEST {
+		t.Fatalf("old request code = %d", code)
+	}
+
+	// 客户端自己的重连使用新的序号
+	go io.Copy(sconn, sconn)
+	conn.baseForTest().Close()
+	echoCheck(t, conn)
+}
+
+func Test_Reconn_StaleRetry(t *testing.T) {
+	listener, conn, sconn := testConns(t, guardConfig, guardConfig)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 客户端的下一个序号已经被用掉，收到 STALE 后换新的序号重试
+	sconn.reconnSeq.Store(conn.reconnSeq.Load() + 1)
+	go io.Copy(sconn, sconn)
+	conn.baseForTest().Close()
+	echoCheck(t, conn)
+}
+
+func Test_Reconn_DrainReplay(t *testing.T) {
+	listener, conn, sconn := testConns(t, guardConfig, guardConfig)
+	defer listener.Close()
+	defer conn.Close()
+	addr := listener.Addr().String()
+
+	// 会话已经接受过这个请求
+	req := conn.reconnRequest()
+	sconn.reconnSeq.Store(binary.LittleEndian.Uint64(req[25:33]))
+
+	// 关闭期间重放旧的请求不能关闭会话
+	listener.draining.Store(true)
+	if code := rawReconn(t, addr, req); code != RECONN_SHUTTING_DOWN {
+		t.Fatalf("code = %d", code)
+	}
+	if _, exists := listener.getConn(conn.id); !exists {
+		t.Fatalf("session closed by replay")
+	}
+	if code := rawReconn(t, addr, conn.reconnRequest()); code != RECONN_SHUTTING_DOWN {
+		t.Fatalf("code = %d", code)
+	}
+	for i := 0; ; i++ {
+		if _, exists := listener.getConn(conn.id); !exists {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("session not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Reconn_Lockout(t *testing.T) {
+	config := guardConfig
+	config.MaxReconnectFailures = 2
+	config.ReconnectLockout = 200 * time.Millisecond
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+	addr := listener.Addr().String()
+
+	bad := conn.reconnRequest()
+	bad[len(bad)-1] ^= 0xFF
+	for i := 0; i < 2; i++ {
+		if code := rawReconn(t, addr, bad); code != RECONN_AUTH_FAILED {
+			t.Fatalf("code = %d", code)
+		}
+	}
+	if code := rawReconn(t, addr, conn.reconnRequest()); code != RECONN_TRY_LATER {
+		t.Fatalf("locked code = %d", code)
+	}
+
+	// 锁定期间客户端继续重试，锁定结束后重连成功
+	go io.Copy(sconn, sconn)
+	conn.baseForTest().Close()
+	echoCheck(t, conn)
+}
+
+func Test_Reconn_RateLimit(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	config := guardConfig
+	config.ReconnectRate = 0.1
+	config.ReconnectBurst = 1
+	config.Metrics = metrics
+	listener, conn, _ := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+	addr := listener.Addr().String()
+
+	if code := rawReconn(t, addr, conn.reconnRequest()); code != RECONN_OK {
+		t.Fatalf("code = %d", code)
+	}
+	if code := rawReconn(t, addr, conn.reconnRequest()); code != RECONN_TRY_LATER {
+		t.Fatalf("rate limited code = %d", code)
+	}
+	if n := metrics.Snapshot().ReconnectRefusals["try_later"]; n != 1 {
+		t.Fatalf("refusals = %d", n)
+	}
+}
+
+func Test_Reconn_TrustedPeers(t *testing.T) {
+	config := guardConfig
+	config.ReconnectRate = 0.1
+	config.ReconnectBurst = 1
+	config.TrustedPeers = []string{"127.0.0.1"}
+	listener, conn, _ := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+	addr := listener.Addr().String()
+
+	// 其它节点转发的重连不受频率限制
+	for i := 0; i < 3; i++ {
+		if code := rawReconn(t, addr, conn.reconnRequest()); code != RECONN_OK {
+			t.Fatalf("code = %d", code)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package snet
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+var ErrBadRecord = newError("snet: record authentication failed", false, net.ErrClosed)
+
+const (
+	RECORD_DATA byte = 0x00
+	RECORD_PING byte = 0x01
+	RECORD_PONG byte = 0x02
+	RECORD_ACK  byte = 0x03
+)
+
+const (
+	recordHeaderSize = 3
+	maxRecordPayload = 16 * 1024
+)
+
+// 新版握手建立的连接，数据被切分成记录后再写入底层连接：
+//
+//	+------+--------+-----------------+
+//	| Type | Length |     Payload     |
+//	+------+--------+-----------------+
+//	 1 byte  2 byte     Length byte
+//
+// 心跳等控制记录与数据记录一样计入收发字节数和重传缓冲区，重连后重传的记录与原来完全一致，
+// 所以流式加密器的状态和 AEAD 按序号推算出的 nonce 都能保持同步。
+type recordCipher struct {
+	stream Cipher
+	offset uint64
+
+	aead  cipher.AEAD
+	iv    []byte
+	nonce []byte
+	seq   uint64
+}
+
+func newStreamRecordCipher(stream Cipher) *recordCipher {
+	return &recordCipher{stream: stream}
+}
+
+func newRecordCipher(aead cipher.AEAD, iv []byte) *recordCipher {
+	return &recordCipher{
+		aead:  aead,
+		iv:    iv,
+		nonce: make([]byte, len(iv)),
+	}
+}
+
+func (rc *recordCipher) overhead() int {
+	if rc.aead == nil {
+		return 0
+	}
+	return rc.aead.Overhead()
+}
+
+// nonce 为初始向量与记录序号异或，序号不在线路上传输
+func (rc *recordCipher) nextNonce() []byte {
+	copy(rc.nonce, rc.iv)
+	n := len(rc.nonce)
+	for i := 0; i < 8; i++ {
+		rc.nonce[n-1-i] ^= byte(rc.seq >> (8 * i))
+	}
+	rc.seq++
+	return rc.nonce
+}
+
+// 把 b 切分成记录加密后追加到 dst，控制记录的 b 可以为空
+func (rc *recordCipher) Seal(dst []byte, typ byte, b []byte) []byte {
+	for first := true; first || len(b) > 0; first = false {
+		n := min(len(b), maxRecordPayload)
+		dst = append(dst, typ)
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(n+rc.overhead()))
+		if rc.aead != nil {
+			header := dst[len(dst)-recordHeaderSize:]
+			dst = rc.aead.Seal(dst, rc.nextNonce(), b[:n], header)
+		} else {
+			dst = slices.Grow(dst, n)
+			rc.stream.XORKeyStream(dst[len(dst):len(dst)+n], b[:n])
+			dst = dst[:len(dst)+n]
+			rc.offset += uint64(n)
+		}
+		b = b[n:]
+	}
+	return dst
+}
+
+// 返回 b 开头第一条完整记录的长度，数据不足一条记录时返回 0
+func (rc *recordCipher) RecordSize(b []byte) (int, error) {
+	if len(b) < recordHeaderSize {
+		return 0, nil
+	}
+
+	size := int(binary.LittleEndian.Uint16(b[1:]))
+	if size < rc.overhead() || size > maxRecordPayload+rc.overhead() {
+		return 0, ErrBadRecord
+	}
+
+	if len(b) < recordHeaderSize+size {
+		return 0, nil
+	}
+	return recordHeaderSize + size, nil
+}
+
+// 解密一条完整的记录，明文追加到 dst
+func (rc *recordCipher) Open(dst, record []byte) (typ byte, b []byte, err error) {
+	header, payload := record[:recordHeaderSize], record[recordHeaderSize:]
+	if rc.aead != nil {
+		if b, err = rc.aead.Open(dst, rc.nextNonce(), payload, header); err != nil {
+			return 0, nil, ErrBadRecord
+		}
+	} else {
+		b = slices.Grow(dst, len(payload))[:len(dst)+len(payload)]
+		rc.stream.XORKeyStream(b[len(dst):], payload)
+		rc.offset += uint64(len(payload))
+	}
+	return header[0], b, nil
+}
+
+func (rc *recordCipher) MaxRecordSize() int {
+	return recordHeaderSize + maxRecordPayload + rc.overhead()
+}
+
+// 加密器的状态，AEAD 为记录序号，流式加密为已处理的字节数，用于保存和恢复会话
+func (rc *recordCipher) position() uint64 {
+	if rc.aead != nil {
+		return rc.seq
+	}
+	return rc.offset
+}
+
+func (rc *recordCipher) seek(pos uint64) {
+	if rc.aead != nil {
+		rc.seq = pos
+		return
+	}
+	skipKeyStream(rc.stream, pos)
+	rc.offset = pos
+}
+
+// 流式加密器只能从头推算，跳过 n 个字节的密钥流
+func skipKeyStream(stream Cipher, n uint64) {
+	var buf [4096]byte
+	for n > 0 {
+		m := min(n, uint64(len(buf)))
+		stream.XORKeyStream(buf[:m], buf[:m])
+		n -= m
+	}
+}
@@ -0,0 +1,177 @@
+package snet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rc4"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestRecordCipher(t *testing.T) *recordCipher {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRecordCipher(aead, make([]byte, aead.NonceSize()))
+}
+
+func newTestStreamRecordCipher(t *testing.T) *recordCipher {
+	stream, err := rc4.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newStreamRecordCipher(stream)
+}
+
+func recordTest(t *testing.T, w, r *recordCipher) {
+	var sealed []byte
+	var raws [][]byte
+	for i := 0; i < 100; i++ {
+		raw := RandBytes(maxRecordPayload * 3)
+		raws = append(raws, raw)
+		sealed = w.Seal(sealed, RECORD_DATA, raw)
+		sealed = w.Seal(sealed, RECORD_PING, nil)
+	}
+
+	var plain []byte
+	var pings int
+	for len(sealed) > 0 {
+		size, err := r.RecordSize(sealed)
+		if err != nil || size == 0 {
+			t.Fatalf("size = %d, err = %v", size, err)
+		}
+		typ, b, err := r.Open(plain, sealed[:size])
+		if err != nil {
+			t.Fatalf("open failed: %s", err)
+		}
+		if typ == RECORD_PING {
+			pings++
+		}
+		plain = b
+		sealed = sealed[size:]
+	}
+
+	if pings != len(raws) {
+		t.Fatalf("pings = %d, want %d", pings, len(raws))
+	}
+
+	if !bytes.Equal(plain, bytes.Join(raws, nil)) {
+		t.Fatalf("plain != raw")
+	}
+}
+
+func Test_Record(t *testing.T) {
+	recordTest(t, newTestRecordCipher(t), newTestRecordCipher(t))
+}
+
+func Test_Record_Stream(t *testing.T) {
+	recordTest(t, newTestStreamRecordCipher(t), newTestStreamRecordCipher(t))
+}
+
+func Test_Record_Tamper(t *testing.T) {
+	w := newTestRecordCipher(t)
+	r := newTestRecordCipher(t)
+
+	sealed := w.Seal(nil, RECORD_DATA, []byte("hello"))
+	if size, _ := r.RecordSize(sealed[:len(sealed)-1]); size != 0 {
+		t.Fatalf("incomplete record has size %d", size)
+	}
+
+	sealed[recordHeaderSize] ^= 1
+	if _, _, err := r.Open(nil, sealed); err != ErrBadRecord {
+		t.Fatalf("tampered record opened, err = %v", err)
+	}
+
+	// 记录类型同样受保护
+	sealed = w.Seal(nil, RECORD_DATA, []byte("hello"))
+	sealed[0] = RECORD_PING
+	if _, _, err := r.Open(nil, sealed); err != ErrBadRecord {
+		t.Fatalf("tampered record type opened, err = %v", err)
+	}
+}
+
+func Test_Suite_AES128GCM(t *testing.T) {
+	config := suitesConfig(AES128GCMSuite)
+	ConfigConnTest(t, config, config, true, true)
+}
+
+func Test_Suite_AES256GCM(t *testing.T) {
+	config := suitesConfig(AES256GCMSuite)
+	ConfigConnTest(t, config, config, true, true)
+}
+
+// 篡改握手之后写入的第一个字节
+type tamperConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.writes == 3 {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+func Test_Record_TamperConn(t *testing.T) {
+	config := suitesConfig(AES128GCMSuite)
+
+	listener, err := Listen(config, func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		errChan <- err
+
+		if _, err := conn.Write([]byte("hello")); err == nil {
+			errChan <- io.ErrUnexpectedEOF
+		}
+		errChan <- nil
+	}()
+
+	conn, err := Dial(config, func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return &tamperConn{Conn: conn}, nil
+	})
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	if err := <-errChan; err != ErrBadRecord {
+		t.Fatalf("err = %v, want ErrBadRecord", err)
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("conn not closed after bad record")
+	}
+}
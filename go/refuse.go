@@ -0,0 +1,73 @@
+package snet
+
+import (
+	"log/slog"
+	"net"
+)
+
+// TYPE_RECONN2 重连响应的状态码
+const (
+	RECONN_OK               byte = 0x00
+	RECONN_UNKNOWN_SESSION  byte = 0x01
+	RECONN_AUTH_FAILED      byte = 0x02
+	RECONN_BUFFER_OVERRUN   byte = 0x03
+	RECONN_SHUTTING_DOWN    byte = 0x04
+	RECONN_SESSION_MIGRATED byte = 0x05
+	RECONN_STALE_REQUEST    byte = 0x06
+	RECONN_TRY_LATER        byte = 0x07
+)
+
+var (
+	// 旧版服务端拒绝重连时不带原因，返回 ErrReconnectRefused
+	//
+	// Deprecated: 使用 ErrReconnectRefused。
+	ErrReconnRefused = ErrReconnectRefused
+
+	ErrUnknownSession  = subError("snet: reconnect refused, unknown session", ErrReconnectRefused)
+	ErrAuthFailed      = subError("snet: reconnect refused, authentication failed", ErrReconnectRefused)
+	ErrBufferOverrun   = subError("snet: reconnect refused, retransmission buffer overrun", ErrReconnectRefused, ErrDataLost)
+	ErrServerShutdown  = subError("snet: reconnect refused, server shutting down", ErrReconnectRefused)
+	ErrSessionMigrated = subError("snet: reconnect refused, session migrated", ErrReconnectRefused)
+	ErrStaleRequest    = subError("snet: reconnect refused, stale request", ErrReconnectRefused)
+)
+
+func refuseError(code byte) error {
+	switch code {
+	case RECONN_UNKNOWN_SESSION:
+		return ErrUnknownSession
+	case RECONN_AUTH_FAILED:
+		return ErrAuthFailed
+	case RECONN_BUFFER_OVERRUN:
+		return ErrBufferOverrun
+	case RECONN_SHUTTING_DOWN:
+		return ErrServerShutdown
+	case RECONN_SESSION_MIGRATED:
+		return ErrSessionMigrated
+	case RECONN_STALE_REQUEST:
+		return ErrStaleRequest
+	}
+	return ErrReconnectRefused
+}
+
+// TYPE_RECONN2 和 TYPE_RECONN3 的响应在 24 个字节前加上 1 个字节的状态码，
+// 旧版响应没有状态码，拒绝时 24 个字节全部为 0
+func writeReconnResponse(conn net.Conn, reconnType, code byte, buf []byte) error {
+	if reconnType != TYPE_RECONN {
+		buf = append([]byte{code}, buf...)
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+func (l *Listener) refuseReconn(conn net.Conn, reconnType, code byte) {
+	l.log(slog.LevelWarn, "reconnect refused", "reason", refuseReason(code), "remote_addr", conn.RemoteAddr().String())
+	l.config.metrics().ReconnectRefused(refuseReason(code))
+	// 旧版客户端收到全 0 的响应会关闭连接，需要稍后再试时直接断开，让客户端继续重连
+	if code == RECONN_TRY_LATER && reconnType == TYPE_RECONN {
+		conn.Close()
+		return
+	}
+	var buf [24]byte
+	writeReconnResponse(conn, reconnType, code, buf[:])
+	conn.Close()
+}
@@ -2,16 +2,162 @@ package snet
 
 import (
 	"io"
+	"sync/atomic"
 )
 
+// 重传缓冲区，保存最近写入的数据。
+// max 大于当前大小时，数据放不下会先扩容，扩容超出 min 的部分从 budget 中申请，申请不到时覆盖最早的数据；
+// 有 spool 时被覆盖的数据先移入 spool
 type rewriter struct {
 	data   []byte
 	head   int
 	length int
+
+	min    int
+	max    int
+	budget *rewriterBudget
+	spool  *spool
+}
+
+func newRewriter(size, max int) rewriter {
+	return rewriter{
+		data: make([]byte, size),
+		min:  size,
+		max:  max,
+	}
+}
+
+// rewriterBudget 同一个 Listener 上所有连接共享的扩容额度
+type rewriterBudget struct {
+	avail atomic.Int64
+}
+
+func newRewriterBudget(size int64) *rewriterBudget {
+	if size <= 0 {
+		return nil
+	}
+	b := &rewriterBudget{}
+	b.avail.Store(size)
+	return b
+}
+
+// 申请 n 个字节，额度不足时返回剩余的额度
+func (b *rewriterBudget) acquire(n int) int {
+	if b == nil {
+		return n
+	}
+	for {
+		avail := b.avail.Load()
+		granted := min(int64(n), avail)
+		if granted <= 0 {
+			return 0
+		}
+		if b.avail.CompareAndSwap(avail, avail-granted) {
+			return int(granted)
+		}
+	}
+}
+
+func (b *rewriterBudget) release(n int) {
+	if b != nil && n > 0 {
+		b.avail.Add(int64(n))
+	}
+}
+
+// 保证能再放入 n 个字节而不覆盖旧数据，不能超过 max 和共享额度
+func (r *rewriter) grow(n int) {
+	need := r.length + n
+	if need <= len(r.data) || len(r.data) >= r.max {
+		return
+	}
+
+	size := min(max(need, 2*len(r.data)), r.max)
+	size = len(r.data) + r.budget.acquire(size-len(r.data))
+	if size > len(r.data) {
+		r.resize(size)
+	}
+}
+
+// 空闲时缩小到 min，归还扩容时申请的额度。
+// 最新的 keep 个字节对方还没有确认，放不进缓冲区和 spool 时只缩小到能放下的大小
+func (r *rewriter) shrink(keep int) {
+	size := max(r.min, keep-r.spool.Size())
+	if len(r.data) > size {
+		r.spill(r.length - size)
+		r.budget.release(len(r.data) - size)
+		r.resize(size)
+	}
+}
+
+// 连接关闭后归还额度，之后不再扩容
+func (r *rewriter) release() {
+	if len(r.data) > r.min {
+		r.budget.release(len(r.data) - r.min)
+	}
+	r.budget = nil
+	r.min, r.max = len(r.data), 0
+	r.spool.Close()
+	r.spool = nil
+}
+
+func (r *rewriter) resize(size int) {
+	data := make([]byte, size)
+	n := min(r.length, size)
+	first, second := r.tail(n)
+	copy(data[copy(data, first):], second)
+	r.data, r.head, r.length = data, n, n
+	if n == size {
+		r.head = 0
+	}
+}
+
+// 最新写入的 n 个字节，跨越缓冲区尾部时分成两段
+func (r *rewriter) tail(n int) (first, second []byte) {
+	if n <= r.head {
+		return r.data[r.head-n : r.head], nil
+	}
+	return r.data[r.head-n+len(r.data):], r.data[:r.head]
+}
+
+// 把最早的 n 个字节移入 spool
+func (r *rewriter) spill(n int) {
+	n = min(n, r.length)
+	if r.spool == nil || n <= 0 {
+		return
+	}
+	first, second := r.tail(r.length)
+	if n <= len(first) {
+		r.spool.Write(first[:n])
+		return
+	}
+	r.spool.Write(first)
+	r.spool.Write(second[:n-len(first)])
+}
+
+// 只保留最新的 n 个字节，更早的数据对方已经确认收到
+func (r *rewriter) trim(n uint64) {
+	if uint64(r.length) > n {
+		r.length = int(n)
+		r.spool.trim(0)
+		return
+	}
+	r.spool.trim(int(min(n-uint64(r.length), uint64(r.spool.Len()))))
+}
+
+func (r *rewriter) Buffered() int {
+	return r.length + r.spool.Len()
+}
+
+// 不覆盖旧数据时最多能保存的字节数
+func (r *rewriter) capacity() int {
+	return len(r.data) + r.spool.Size()
 }
 
 func (r *rewriter) Push(b []byte) {
+	r.grow(len(b))
+	r.spill(r.length + len(b) - len(r.data))
 	if len(b) >= len(r.data) {
+		r.spool.Write(b[:len(b)-len(r.data)])
 		drop := len(b) - len(r.data)
 		copy(r.data, b[drop:])
 		r.head, r.length = 0, len(r.data)
@@ -19,24 +165,38 @@ func (r *rewriter) Push(b []byte) {
 	}
 
 	size := copy(r.data[r.head:], b)
-
-	remain := len(b) - size
-
-	if remain == 0 {
+	if remain := len(b) - size; remain > 0 {
+		r.head = copy(r.data, b[size:])
+	} else {
 		r.head += size
 		if r.head == len(r.data) {
 			r.head = 0
 		}
+	}
+	r.length = min(r.length+len(b), len(r.data))
+}
 
-		if r.length != len(r.data) {
-			r.length += len(r.data)
-		}
+// 把 b 用 xor 加密后直接放入缓冲区，省去一次复制，b 不会被修改。
+// 返回缓冲区中加密后的数据，跨越缓冲区尾部时分成两段；b 需小于缓冲区大小，调用前先 grow
+func (r *rewriter) PushXOR(xor Cipher, b []byte) (first, second []byte) {
+	r.spill(r.length + len(b) - len(r.data))
+	size := min(len(b), len(r.data)-r.head)
+	first = r.data[r.head : r.head+size]
+	xor.XORKeyStream(first, b[:size])
+
+	if remain := len(b) - size; remain > 0 {
+		second = r.data[:remain]
+		xor.XORKeyStream(second, b[size:])
+		r.head = remain
 	} else {
-		r.head = copy(r.data, b[size:])
-		if r.length != len(r.data) {
-			r.length = len(r.data)
+		r.head += size
+		if r.head == len(r.data) {
+			r.head = 0
 		}
 	}
+
+	r.length = min(r.length+len(b), len(r.data))
+	return
 }
 
 func (r *rewriter) Rewrite(w io.Writer, writeCount, readCount uint64) bool {
@@ -45,18 +205,24 @@ func (r *rewriter) Rewrite(w io.Writer, writeCount, readCount uint64) bool {
 	switch {
 	case n == 0:
 		return true
-	case n < 0 || n > r.length:
+	case n < 0 || n > r.Buffered():
 		return false
-	case n <= r.head:
-		_, err := w.Write(r.data[r.head-n : r.head])
-		return err == nil
 	}
 
-	offset := r.head - n + len(r.data)
-	if _, err := w.Write(r.data[offset:]); err != nil {
-		return false
+	if spooled := n - r.length; spooled > 0 {
+		if err := r.spool.WriteTo(w, spooled); err != nil {
+			return false
+		}
+		n = r.length
 	}
 
-	_, err := w.Write(r.data[:r.head])
-	return err == nil
+	first, second := r.tail(n)
+	if _, err := w.Write(first); err != nil {
+		return false
+	}
+	if len(second) > 0 {
+		_, err := w.Write(second)
+		return err == nil
+	}
+	return true
 }
@@ -3,8 +3,11 @@ package snet
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"math/rand"
+	"net"
 	"testing"
+	"time"
 )
 
 type rewriterTester struct {
@@ -120,3 +123,144 @@ func (w *ByteWriter) Write(b []byte) (int, error) {
 	w.n += len(b)
 	return len(b), nil
 }
+
+func Test_Rewriter_PushXOR(t *testing.T) {
+	writer := &rewriter{data: make([]byte, 100)}
+	tester := &rewriterTester{writer, t, nil}
+
+	var raw []byte
+	for i := 0; i < 1000; i++ {
+		b := RandBytes(99)
+		src := append([]byte(nil), b...)
+		first, second := writer.PushXOR(noneCipher{}, b)
+		if !bytes.Equal(append(first, second...), src) || !bytes.Equal(b, src) {
+			t.Fatalf("first = %v, second = %v, b = %v", first, second, src)
+		}
+
+		raw = append(raw, b...)
+		if len(raw) > 100 {
+			raw = raw[len(raw)-100:]
+		}
+		tester.Match(uint64(len(raw)), 0, raw)
+	}
+}
+
+func Test_Rewriter_Grow(t *testing.T) {
+	writer := newRewriter(4, 16)
+	tester := &rewriterTester{&writer, t, nil}
+
+	var raw []byte
+	for i := 0; i < 3; i++ {
+		b := []byte{byte(i), byte(i), byte(i)}
+		writer.Push(b)
+		raw = append(raw, b...)
+	}
+	if len(writer.data) != 16 || writer.Buffered() != 9 {
+		t.Fatalf("size = %d, buffered = %d", len(writer.data), writer.Buffered())
+	}
+	tester.Match(9, 0, raw)
+
+	for i := 3; i < 8; i++ {
+		b := []byte{byte(i), byte(i), byte(i)}
+		writer.Push(b)
+		raw = append(raw, b...)
+	}
+	if len(writer.data) != 16 || writer.Buffered() != 16 {
+		t.Fatalf("size = %d, buffered = %d", len(writer.data), writer.Buffered())
+	}
+	tester.Match(16, 0, raw[len(raw)-16:])
+
+	// 对方未确认的数据不会被缩掉
+	writer.shrink(10)
+	if len(writer.data) != 10 || writer.Buffered() != 10 {
+		t.Fatalf("size = %d, buffered = %d", len(writer.data), writer.Buffered())
+	}
+	tester.Match(10, 0, raw[len(raw)-10:])
+
+	writer.shrink(0)
+	if len(writer.data) != 4 || writer.Buffered() != 4 {
+		t.Fatalf("size = %d, buffered = %d", len(writer.data), writer.Buffered())
+	}
+	tester.Match(4, 0, raw[len(raw)-4:])
+}
+
+func Test_Rewriter_Budget(t *testing.T) {
+	budget := newRewriterBudget(8)
+	w1, w2 := newRewriter(4, 16), newRewriter(4, 16)
+	w1.budget, w2.budget = budget, budget
+
+	w1.Push(make([]byte, 12))
+	w2.Push(make([]byte, 12))
+	if len(w1.data) != 12 || len(w2.data) != 4 || w2.Buffered() != 4 {
+		t.Fatalf("w1 = %d, w2 = %d", len(w1.data), len(w2.data))
+	}
+
+	w1.shrink(0)
+	w2.Push(make([]byte, 8))
+	if len(w2.data) != 12 || w2.Buffered() != 12 {
+		t.Fatalf("w2 = %d, buffered = %d", len(w2.data), w2.Buffered())
+	}
+
+	w2.release()
+	if budget.avail.Load() != 8 {
+		t.Fatalf("budget = %d after release", budget.avail.Load())
+	}
+}
+
+func Test_Rewriter_Burst(t *testing.T) {
+	config := Config{
+		RewriterBufferSize: 64,
+		RewriterMaxSize:    64 * 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	b := RandBytes(32 * 1024)
+	conn.baseForTest().Close()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	buf := make([]byte, len(b))
+	if _, err := io.ReadFull(sconn, buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(buf, b) {
+		t.Fatalf("buf != b")
+	}
+}
+
+func Test_Rewriter_IdleShrink(t *testing.T) {
+	config := Config{
+		RewriterBufferSize:  64,
+		RewriterMaxSize:     128 * 1024,
+		RewriterIdleTimeout: 50 * time.Millisecond,
+		ReconnWaitTimeout:   time.Minute,
+	}
+
+	listener, conn, sconn := testConns(t, config, config)
+	defer listener.Close()
+	defer conn.Close()
+
+	// 服务端写出的数据全部丢失，空闲超时后缓冲区不能缩掉这些数据
+	sconn.WrapBaseForTest(func(base net.Conn) net.Conn {
+		return muteConn{base}
+	})
+	b := randBlock(64 * 1024)
+	if _, err := sconn.Write(b); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	conn.baseForTest().Close()
+	buf := make([]byte, len(b))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(buf, b) {
+		t.Fatalf("buf != b")
+	}
+}
@@ -0,0 +1,278 @@
+package snet
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrSessionHandedOff = newError("snet: session handed off to another process", false, net.ErrClosed)
+
+// Session 服务端会话的快照，包含会话密钥，需要妥善保管
+type Session struct {
+	ID          uint64
+	RemoteAddr  string
+	Legacy      bool
+	EnableCrypt bool
+	Proof       byte
+
+	// 旧版握手的会话只需要 Key，新版握手的会话从 Secret 和 Salt 重新派生密钥
+	Key    []byte
+	Suite  byte
+	Secret []byte
+	Salt   []byte
+
+	// 收发字节数，以及记录层加密器的状态
+	WriteCount uint64
+	ReadCount  uint64
+	PeerAcked  uint64
+	ReconnSeq  uint64
+	WritePos   uint64
+	ReadPos    uint64
+
+	// 重传缓冲区中的数据、重读队列中的数据、已收到但还没有解密的记录、已解密但应用层还没有读取的数据
+	Rewrite []byte
+	Pending []byte
+	ReadBuf []byte
+	Unread  []byte
+}
+
+// SessionStore 平滑重启时在新旧进程之间传递会话
+type SessionStore interface {
+	Save(sessions []*Session) error
+	Load() ([]*Session, error)
+}
+
+// FileSessionStore 把会话保存在一个文件中，文件权限为 0600。
+// Load 读取后删除文件，避免同一批会话被恢复两次
+type FileSessionStore struct {
+	Path string
+}
+
+func (s FileSessionStore) Save(sessions []*Session) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sessions); err != nil {
+		return err
+	}
+
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+func (s FileSessionStore) Load() ([]*Session, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&sessions); err != nil {
+		return nil, err
+	}
+	return sessions, os.Remove(s.Path)
+}
+
+// Handoff 等待正在进行的握手和重连结束的最长时间，超时后关闭这些连接，客户端会重连到新进程
+const handoffWait = 5 * time.Second
+
+// Handoff 平滑重启时由旧进程调用：停止接受新连接，等待正在进行的握手和重连结束，
+// 保存所有会话后关闭会话和 Listener，会话的 Read 和 Write 返回 ErrSessionHandedOff。
+// 还没有发送请求的连接直接关闭，其余的最多等待 handoffWait。
+// 调用前需要先把监听的 socket 复制给新进程（例如 net.TCPListener 的 File），否则关闭后无法再接受重连
+func (l *Listener) Handoff(store SessionStore) error {
+	l.base.Close()
+	<-l.acceptDone
+	l.closePending(false)
+
+	done := make(chan struct{})
+	go func() {
+		l.handshakes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(handoffWait):
+		l.closePending(true)
+		<-done
+	}
+
+	conns := l.allConns()
+	sessions := make([]*Session, 0, len(conns))
+	for _, conn := range conns {
+		if s := conn.handoff(); s != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	err := store.Save(sessions)
+	l.log(slog.LevelInfo, "sessions handed off", "sessions", len(sessions), "err", err)
+	l.Close()
+	return err
+}
+
+// 断开底层连接让阻塞在底层连接上的 Read 和 Write 进入等待重连的状态，再在 reconnMutex 的保护下生成快照。
+// 释放锁之前关闭会话，之后的 Read 和 Write 不会再读写已经放进快照的数据
+func (c *Conn) handoff() *Session {
+	c.reconnOpMutex.Lock()
+	defer c.reconnOpMutex.Unlock()
+
+	c.base.Close()
+	c.reconnMutex.Lock()
+	defer c.reconnMutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	s := c.session()
+	c.closeWithError(ErrSessionHandedOff)
+	return s
+}
+
+// 调用者需持有 reconnMutex
+func (c *Conn) session() *Session {
+	s := &Session{
+		ID:          c.id,
+		RemoteAddr:  c.base.RemoteAddr().String(),
+		Legacy:      c.legacy,
+		EnableCrypt: c.enableCrypt,
+		Proof:       c.proof,
+		Key:         c.key,
+		Suite:       c.suite,
+		Secret:      c.secret,
+		Salt:        c.salt,
+		WriteCount:  c.writeCount,
+		ReadCount:   c.readCount,
+		PeerAcked:   c.peerAcked.Load(),
+		ReconnSeq:   c.reconnSeq.Load(),
+		Unread:      bytes.Clone(c.readPlain),
+	}
+	if c.writeRecord != nil {
+		s.WritePos = c.writeRecord.position()
+		s.ReadPos = c.readRecord.position()
+	}
+
+	var buf bytes.Buffer
+	c.rewriter.Rewrite(&buf, uint64(c.rewriter.Buffered()), 0)
+	s.Rewrite = buf.Bytes()
+
+	// readBuf 中的记录已经计入 readCount，可能已经被确认，不能放进重读队列等待对方重传
+	s.ReadBuf = bytes.Clone(c.readBuf)
+	for data := c.rereader.head; data != nil; data = data.next {
+		s.Pending = append(s.Pending, data.Data...)
+	}
+	return s
+}
+
+// ListenRestore 平滑重启时由新进程调用：先恢复 store 中保存的会话再开始接受连接，
+// listenFunc 通常用 net.FileListener 接管旧进程传过来的 socket。
+// 恢复的会话处于断线状态，等待客户端重连，超过 ReconnWaitTimeout 没有重连时被关闭。
+// 流式加密的会话恢复时需要重新推算密钥流，耗时与会话传输过的数据量成正比
+func ListenRestore(config Config, store SessionStore, listenFunc func() (net.Listener, error)) (*Listener, []*Conn, error) {
+	sessions, err := store.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l, err := newListener(config, listenFunc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conns := make([]*Conn, 0, len(sessions))
+	for _, s := range sessions {
+		conn, err := l.restore(s)
+		if err != nil {
+			l.log(slog.LevelWarn, "restore session failed", "conn_id", s.ID, "err", err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+
+	l.start()
+	return l, conns, nil
+}
+
+func (l *Listener) restore(s *Session) (*Conn, error) {
+	c := l.newConn(deadConn{remoteAddr: sessionAddr(s.RemoteAddr)}, s.ID, s.Key)
+	c.legacy = s.Legacy
+	c.enableCrypt = s.EnableCrypt
+	c.proof = s.Proof
+
+	if s.Legacy {
+		if err := c.useLegacyCipher(); err != nil {
+			return nil, err
+		}
+		// 旧版握手的加密器处理过的字节数就是收发字节数，服务端在握手时还用写加密器加密过 8 字节的连接ID
+		skipKeyStream(c.writeCipher, 8)
+		if c.enableCrypt {
+			skipKeyStream(c.writeCipher, s.WriteCount)
+			skipKeyStream(c.readCipher, s.ReadCount)
+		}
+	} else {
+		suite := findSuite(l.config.cipherSuites(), s.Suite)
+		if suite == nil {
+			return nil, ErrNoCipherSuite
+		}
+		if err := c.useSuite(suite, s.Secret, s.Salt, false); err != nil {
+			return nil, err
+		}
+		c.writeRecord.seek(s.WritePos)
+		c.readRecord.seek(s.ReadPos)
+	}
+
+	if len(s.Rewrite) > len(c.rewriter.data) {
+		c.rewriter.resize(len(s.Rewrite))
+		c.rewriter.min = len(s.Rewrite)
+	}
+	c.rewriter.Push(s.Rewrite)
+
+	c.writeCount = s.WriteCount
+	c.readCount = s.ReadCount
+	c.peerAcked.Store(s.PeerAcked)
+	c.reconnSeq.Store(s.ReconnSeq)
+	c.readPlain = s.Unread
+	if len(s.ReadBuf) > 0 {
+		c.readBuf = make([]byte, len(s.ReadBuf), max(len(s.ReadBuf), c.readRecord.MaxRecordSize()))
+		copy(c.readBuf, s.ReadBuf)
+	}
+	if len(s.Pending) > 0 {
+		c.rereader.head = &rereadData{s.Pending, nil}
+		c.rereader.tail = c.rereader.head
+		c.rereader.count = uint64(len(s.Pending))
+	}
+
+	c.listener = l
+	c.lostAt.Store(time.Now().UnixNano())
+	l.putConn(c.id, c)
+	c.startHeartbeat()
+	c.startAck()
+	return c, nil
+}
+
+// 恢复的会话在客户端重连前使用的底层连接
+type deadConn struct {
+	remoteAddr net.Addr
+}
+
+func (deadConn) Read([]byte) (int, error)         { return 0, net.ErrClosed }
+func (deadConn) Write([]byte) (int, error)        { return 0, net.ErrClosed }
+func (deadConn) Close() error                     { return nil }
+func (deadConn) LocalAddr() net.Addr              { return sessionAddr("") }
+func (c deadConn) RemoteAddr() net.Addr           { return c.remoteAddr }
+func (deadConn) SetDeadline(time.Time) error      { return nil }
+func (deadConn) SetReadDeadline(time.Time) error  { return nil }
+func (deadConn) SetWriteDeadline(time.Time) error { return nil }
+
+type sessionAddr string
+
+func (sessionAddr) Network() string  { return "tcp" }
+func (a sessionAddr) String() string { return string(a) }
@@ -0,0 +1,202 @@
+package snet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Session_Handoff(t *testing.T) {
+	for _, config := range []Config{
+		{EnableCrypt: true},
+		{CipherSuites: []CipherSuite{AES128CTRSuite}},
+		{CipherSuites: []CipherSuite{AES128CTRSuite}, AckBytes: 1},
+		{EnableCrypt: true, LegacyHandshake: true},
+	} {
+		config.RewriterBufferSize = 1024
+		config.ReconnWaitTimeout = time.Minute
+		testSessionHandoff(t, config)
+	}
+}
+
+func testSessionHandoff(t *testing.T, config Config) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("get listener file failed: %s", err)
+	}
+	defer file.Close()
+
+	listener, err := Listen(config, func() (net.Listener, error) {
+		return ln, nil
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+
+	cliConfig := config
+	cliConfig.ReconnectPolicy.InitialBackoff = 10 * time.Millisecond
+	conn, err := Dial(cliConfig, func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	sconn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+
+	// 服务端只读取一部分，剩下的数据和还没有解密的记录随会话一起交接
+	up := randBlock(100)
+	conn.Write(up[:50])
+	conn.Write(up[50:])
+	time.Sleep(50 * time.Millisecond)
+	var head [10]byte
+	if _, err := io.ReadFull(sconn, head[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	down := randBlock(100)
+	sconn.Write(down)
+
+	// 开启确认时客户端读取期间收到确认，之后写入时释放已确认的数据
+	b := make([]byte, len(down))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("client read failed: %s", err)
+	}
+	up1 := randBlock(10)
+	conn.Write(up1)
+
+	store := FileSessionStore{Path: filepath.Join(t.TempDir(), "sessions")}
+	if err := listener.Handoff(store); err != nil {
+		t.Fatalf("handoff failed: %s", err)
+	}
+	if _, err := sconn.Read(head[:]); err != ErrSessionHandedOff {
+		t.Fatalf("read after handoff: %v", err)
+	}
+
+	listener2, conns, err := ListenRestore(config, store, func() (net.Listener, error) {
+		return net.FileListener(file)
+	})
+	if err != nil {
+		t.Fatalf("restore failed: %s", err)
+	}
+	defer listener2.Close()
+	if len(conns) != 1 || conns[0].id != sconn.(*Conn).id {
+		t.Fatalf("conns = %v", conns)
+	}
+	sconn2 := conns[0]
+
+	// 客户端在读取时发现断线并重连到新的 Listener
+	up2 := randBlock(100)
+	conn.Write(up2)
+	go sconn2.Write(down)
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("client read failed: %s", err)
+	}
+	if !bytes.Equal(b, down) {
+		t.Fatalf("downstream mismatch")
+	}
+
+	expect := append(append(up[len(head):], up1...), up2...)
+	c := make([]byte, len(expect))
+	if _, err := io.ReadFull(sconn2, c); err != nil {
+		t.Fatalf("server read failed: %s", err)
+	}
+	if !bytes.Equal(c, expect) {
+		t.Fatalf("upstream mismatch")
+	}
+}
+
+func Test_FileSessionStore(t *testing.T) {
+	store := FileSessionStore{Path: filepath.Join(t.TempDir(), "sessions")}
+	if sessions, err := store.Load(); err != nil || sessions != nil {
+		t.Fatalf("load empty store: %v, %v", sessions, err)
+	}
+
+	if err := store.Save([]*Session{{ID: 1, Key: []byte("key"), Rewrite: []byte("data")}}); err != nil {
+		t.Fatalf("save failed: %s", err)
+	}
+	sessions, err := store.Load()
+	if err != nil || len(sessions) != 1 || sessions[0].ID != 1 || string(sessions[0].Rewrite) != "data" {
+		t.Fatalf("load failed: %v, %v", sessions, err)
+	}
+
+	if sessions, _ := store.Load(); sessions != nil {
+		t.Fatalf("sessions restored twice")
+	}
+}
+
+func Test_Session_HandoffIdleConn(t *testing.T) {
+	listener := testListen(t, Config{})
+
+	// 不发送任何数据的连接不能让 Handoff 一直等待
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Handoff(FileSessionStore{Path: filepath.Join(t.TempDir(), "sessions")})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("handoff failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handoff blocked by idle conn")
+	}
+}
+
+// Save 期间调用 saving，之后才返回
+type hookStore struct {
+	SessionStore
+	saving func()
+}
+
+func (s hookStore) Save(sessions []*Session) error {
+	s.saving()
+	return s.SessionStore.Save(sessions)
+}
+
+func Test_Session_HandoffRead(t *testing.T) {
+	config := Config{
+		CipherSuites:       []CipherSuite{AES128CTRSuite},
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+	listener, conn, sconn := testConns(t, config, config)
+	defer conn.Close()
+
+	conn.Write(randBlock(100))
+	var head [10]byte
+	if _, err := io.ReadFull(sconn, head[:]); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	// 记录中剩下的数据已经放进快照，保存期间不能再被读取
+	store := hookStore{
+		SessionStore: FileSessionStore{Path: filepath.Join(t.TempDir(), "sessions")},
+		saving: func() {
+			if n, err := sconn.Read(head[:]); err != ErrSessionHandedOff {
+				t.Errorf("read during save: n = %d, err = %v", n, err)
+			}
+		},
+	}
+	if err := listener.Handoff(store); err != nil {
+		t.Fatalf("handoff failed: %s", err)
+	}
+}
@@ -0,0 +1,40 @@
+package snet
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Shutdown 检查会话是否全部关闭的间隔
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown 平滑关闭 Listener：不再接受新连接，已经开始的握手也不会完成，以 RECONN_SHUTTING_DOWN 拒绝重连，
+// 等待应用层关闭所有会话后关闭 Listener。
+// ctx 结束时仍未关闭的会话被强制关闭，Read 和 Write 返回 ErrServerShutdown，
+// Shutdown 返回包含被关闭的会话数量和 ctx.Err() 的错误
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.draining.Store(true)
+	l.log(slog.LevelInfo, "listener draining", "sessions", len(l.allConns()))
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if len(l.allConns()) == 0 {
+			l.log(slog.LevelInfo, "listener drained")
+			return l.Close()
+		}
+		select {
+		case <-ctx.Done():
+			conns := l.allConns()
+			for _, conn := range conns {
+				conn.closeWithError(ErrServerShutdown)
+			}
+			l.log(slog.LevelWarn, "listener shutdown deadline exceeded", "sessions", len(conns))
+			l.Close()
+			return fmt.Errorf("snet: shutdown closed %d sessions: %w", len(conns), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package snet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var shutdownConfig = Config{
+	EnableCrypt:        true,
+	RewriterBufferSize: 1024,
+	ReconnWaitTimeout:  time.Minute,
+	ReconnectPolicy:    ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+}
+
+func Test_Shutdown_Drain(t *testing.T) {
+	listener, conn, sconn := testConns(t, shutdownConfig, shutdownConfig)
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Shutdown(context.Background())
+	}()
+	for !listener.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 不再接受新连接
+	if _, err := Dial(Config{EnableCrypt: true}, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	}); err == nil {
+		t.Fatalf("dial succeeded while draining")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned before sessions closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sconn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+}
+
+// 在写出握手的验证码之前等待 gate
+type gateConn struct {
+	net.Conn
+	waiting chan struct{}
+	gate    chan struct{}
+}
+
+func (c *gateConn) Write(b []byte) (int, error) {
+	if len(b) == proofSize {
+		close(c.waiting)
+		<-c.gate
+	}
+	return c.Conn.Write(b)
+}
+
+func Test_Shutdown_PendingHandshake(t *testing.T) {
+	listener, conn, sconn := testConns(t, shutdownConfig, shutdownConfig)
+	defer conn.Close()
+	defer sconn.Close()
+
+	gc := &gateConn{waiting: make(chan struct{}), gate: make(chan struct{})}
+	dialed := make(chan struct{})
+	go func() {
+		defer close(dialed)
+		Dial(Config{EnableCrypt: true}, func() (net.Conn, error) {
+			var err error
+			gc.Conn, err = net.Dial("tcp", listener.Addr().String())
+			return gc, err
+		})
+	}()
+	<-gc.waiting
+
+	go listener.Shutdown(context.Background())
+	for !listener.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Shutdown 之前开始的握手完成后不会成为新的会话
+	close(gc.gate)
+	<-dialed
+	gc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(gc, make([]byte, 1)); err != io.EOF {
+		t.Fatalf("handshake completed while draining: %v", err)
+	}
+	if n := len(listener.allConns()); n != 1 {
+		t.Fatalf("sessions = %d", n)
+	}
+	if n := len(listener.acceptChan); n != 0 {
+		t.Fatalf("backlog = %d", n)
+	}
+}
+
+func Test_Shutdown_RefuseReconn(t *testing.T) {
+	listener, conn, sconn := testConns(t, shutdownConfig, shutdownConfig)
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Shutdown(context.Background())
+	}()
+	for !listener.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 拒绝重连的同时关闭服务端的会话
+	conn.baseForTest().Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrServerShutdown) {
+		t.Fatalf("client err = %v, want ErrServerShutdown", err)
+	}
+	if _, err := sconn.Read(make([]byte, 1)); !errors.Is(err, ErrServerShutdown) {
+		t.Fatalf("server err = %v, want ErrServerShutdown", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+}
+
+func Test_Shutdown_Deadline(t *testing.T) {
+	listener, conn, sconn := testConns(t, shutdownConfig, shutdownConfig)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := listener.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	if _, err := sconn.Read(make([]byte, 1)); !errors.Is(err, ErrServerShutdown) {
+		t.Fatalf("server err = %v, want ErrServerShutdown", err)
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Fatalf("accept succeeded after shutdown")
+	}
+}
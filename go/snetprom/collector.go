@@ -0,0 +1,89 @@
+// Package snetprom 把 snet.MemoryMetrics 中的统计数据导出给 Prometheus
+package snetprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	snet "github.com/funny/snet/go"
+)
+
+var _ prometheus.Collector = &Collector{}
+
+// Collector 每次采集时读取 MemoryMetrics 的快照
+type Collector struct {
+	metrics *snet.MemoryMetrics
+
+	handshakes        *prometheus.Desc
+	handshakeDrops    *prometheus.Desc
+	reconnectAttempts *prometheus.Desc
+	reconnects        *prometheus.Desc
+	refusals          *prometheus.Desc
+	retransmitted     *prometheus.Desc
+	rewriterOverflows *prometheus.Desc
+	sessions          *prometheus.Desc
+	latency           *prometheus.Desc
+}
+
+func NewCollector(namespace string, metrics *snet.MemoryMetrics) *Collector {
+	name := func(name string) string {
+		return prometheus.BuildFQName(namespace, "snet", name)
+	}
+	return &Collector{
+		metrics: metrics,
+		handshakes: prometheus.NewDesc(name("handshakes_total"),
+			"Number of new connection handshakes by result.", []string{"result"}, nil),
+		handshakeDrops: prometheus.NewDesc(name("handshake_drops_total"),
+			"Number of connections dropped by handshake limits by reason.", []string{"reason"}, nil),
+		reconnectAttempts: prometheus.NewDesc(name("reconnect_attempts_total"),
+			"Number of reconnect attempts made or received.", nil, nil),
+		reconnects: prometheus.NewDesc(name("reconnects_total"),
+			"Number of successful reconnects.", nil, nil),
+		refusals: prometheus.NewDesc(name("reconnect_refusals_total"),
+			"Number of refused reconnects by reason.", []string{"reason"}, nil),
+		retransmitted: prometheus.NewDesc(name("retransmitted_bytes_total"),
+			"Bytes retransmitted after reconnects by direction.", []string{"direction"}, nil),
+		rewriterOverflows: prometheus.NewDesc(name("rewriter_overflows_total"),
+			"Number of times data needed for retransmission did not fit in the rewriter buffer, including unacknowledged data overwritten when acks are enabled.", nil, nil),
+		sessions: prometheus.NewDesc(name("sessions"),
+			"Number of live server sessions.", nil, nil),
+		latency: prometheus.NewDesc(name("reconnect_latency_seconds"),
+			"Time from detecting a broken link to a successful reconnect.", nil, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.handshakes
+	ch <- c.handshakeDrops
+	ch <- c.reconnectAttempts
+	ch <- c.reconnects
+	ch <- c.refusals
+	ch <- c.retransmitted
+	ch <- c.rewriterOverflows
+	ch <- c.sessions
+	ch <- c.latency
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.metrics.Snapshot()
+
+	ch <- prometheus.MustNewConstMetric(c.handshakes, prometheus.CounterValue, float64(s.HandshakesAccepted), "accepted")
+	ch <- prometheus.MustNewConstMetric(c.handshakes, prometheus.CounterValue, float64(s.HandshakesFailed), "failed")
+	for reason, n := range s.HandshakeDrops {
+		ch <- prometheus.MustNewConstMetric(c.handshakeDrops, prometheus.CounterValue, float64(n), reason)
+	}
+	ch <- prometheus.MustNewConstMetric(c.reconnectAttempts, prometheus.CounterValue, float64(s.ReconnectAttempts))
+	ch <- prometheus.MustNewConstMetric(c.reconnects, prometheus.CounterValue, float64(s.ReconnectSuccesses))
+	for reason, n := range s.ReconnectRefusals {
+		ch <- prometheus.MustNewConstMetric(c.refusals, prometheus.CounterValue, float64(n), reason)
+	}
+	ch <- prometheus.MustNewConstMetric(c.retransmitted, prometheus.CounterValue, float64(s.BytesRewritten), "rewrite")
+	ch <- prometheus.MustNewConstMetric(c.retransmitted, prometheus.CounterValue, float64(s.BytesReread), "reread")
+	ch <- prometheus.MustNewConstMetric(c.rewriterOverflows, prometheus.CounterValue, float64(s.RewriterOverflows))
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(s.Sessions))
+
+	buckets := make(map[float64]uint64, len(s.ReconnectLatency.Buckets))
+	for i, bound := range s.ReconnectLatency.Buckets {
+		buckets[bound] = s.ReconnectLatency.Counts[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(c.latency, s.ReconnectLatency.Count, s.ReconnectLatency.Sum, buckets)
+}
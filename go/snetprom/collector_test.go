@@ -0,0 +1,73 @@
+package snetprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	snet "github.com/funny/snet/go"
+)
+
+func Test_Collector(t *testing.T) {
+	metrics := snet.NewMemoryMetrics()
+	metrics.Handshake(true)
+	metrics.Handshake(false)
+	metrics.HandshakeDropped("backlog")
+	metrics.ReconnectAttempt()
+	metrics.ReconnectAttempt()
+	metrics.Reconnected(30*time.Millisecond, 8, 4)
+	metrics.ReconnectRefused("unknown_session")
+	metrics.RewriterOverflow()
+	metrics.SessionOpened()
+
+	expected := `
+# HELP test_snet_handshake_drops_total Number of connections dropped by handshake limits by reason.
+# TYPE test_snet_handshake_drops_total counter
+test_snet_handshake_drops_total{reason="backlog"} 1
+# HELP test_snet_handshakes_total Number of new connection handshakes by result.
+# TYPE test_snet_handshakes_total counter
+test_snet_handshakes_total{result="accepted"} 1
+test_snet_handshakes_total{result="failed"} 1
+# HELP test_snet_reconnect_attempts_total Number of reconnect attempts made or received.
+# TYPE test_snet_reconnect_attempts_total counter
+test_snet_reconnect_attempts_total 2
+# HELP test_snet_reconnect_latency_seconds Time from detecting a broken link to a successful reconnect.
+# TYPE test_snet_reconnect_latency_seconds histogram
+test_snet_reconnect_latency_seconds_bucket{le="0.01"} 0
+test_snet_reconnect_latency_seconds_bucket{le="0.05"} 1
+test_snet_reconnect_latency_seconds_bucket{le="0.1"} 1
+test_snet_reconnect_latency_seconds_bucket{le="0.25"} 1
+test_snet_reconnect_latency_seconds_bucket{le="0.5"} 1
+test_snet_reconnect_latency_seconds_bucket{le="1"} 1
+test_snet_reconnect_latency_seconds_bucket{le="2.5"} 1
+test_snet_reconnect_latency_seconds_bucket{le="5"} 1
+test_snet_reconnect_latency_seconds_bucket{le="10"} 1
+test_snet_reconnect_latency_seconds_bucket{le="30"} 1
+test_snet_reconnect_latency_seconds_bucket{le="60"} 1
+test_snet_reconnect_latency_seconds_bucket{le="+Inf"} 1
+test_snet_reconnect_latency_seconds_sum 0.03
+test_snet_reconnect_latency_seconds_count 1
+# HELP test_snet_reconnect_refusals_total Number of refused reconnects by reason.
+# TYPE test_snet_reconnect_refusals_total counter
+test_snet_reconnect_refusals_total{reason="unknown_session"} 1
+# HELP test_snet_reconnects_total Number of successful reconnects.
+# TYPE test_snet_reconnects_total counter
+test_snet_reconnects_total 1
+# HELP test_snet_retransmitted_bytes_total Bytes retransmitted after reconnects by direction.
+# TYPE test_snet_retransmitted_bytes_total counter
+test_snet_retransmitted_bytes_total{direction="reread"} 4
+test_snet_retransmitted_bytes_total{direction="rewrite"} 8
+# HELP test_snet_rewriter_overflows_total Number of times data needed for retransmission did not fit in the rewriter buffer, including unacknowledged data overwritten when acks are enabled.
+# TYPE test_snet_rewriter_overflows_total counter
+test_snet_rewriter_overflows_total 1
+# HELP test_snet_sessions Number of live server sessions.
+# TYPE test_snet_sessions gauge
+test_snet_sessions 1
+`
+	collector := NewCollector("test", metrics)
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
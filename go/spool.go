@@ -0,0 +1,107 @@
+package snet
+
+import (
+	"io"
+	"os"
+)
+
+// spool 保存被挤出重传缓冲区的数据，数据循环写入临时文件，只保留最新的 size 个字节。
+// 写入文件失败时丢弃已保存的数据，重连时按数据无法恢复处理
+type spool struct {
+	dir    string
+	size   int
+	file   *os.File
+	end    int // 累计写入的字节数，对 size 取模为下一次写入的位置
+	length int
+}
+
+func newSpool(dir string, size int64) *spool {
+	if size <= 0 {
+		return nil
+	}
+	return &spool{dir: dir, size: int(size)}
+}
+
+func (s *spool) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.length
+}
+
+func (s *spool) Size() int {
+	if s == nil {
+		return 0
+	}
+	return s.size
+}
+
+func (s *spool) Write(b []byte) {
+	if s == nil || len(b) == 0 {
+		return
+	}
+
+	if s.file == nil {
+		file, err := os.CreateTemp(s.dir, "snet-spool-*")
+		if err != nil {
+			s.length = 0
+			return
+		}
+		s.file = file
+	}
+
+	if drop := len(b) - s.size; drop > 0 {
+		s.end += drop
+		b = b[drop:]
+	}
+
+	off := s.end % s.size
+	n := min(len(b), s.size-off)
+	_, err := s.file.WriteAt(b[:n], int64(off))
+	if err == nil && n < len(b) {
+		_, err = s.file.WriteAt(b[n:], 0)
+	}
+	if err != nil {
+		s.length = 0
+		return
+	}
+
+	s.end += len(b)
+	s.length = min(s.length+len(b), s.size)
+}
+
+// 把最新的 n 个字节写入 w
+func (s *spool) WriteTo(w io.Writer, n int) error {
+	off := (s.end - n) % s.size
+	first := min(n, s.size-off)
+	if _, err := io.Copy(w, io.NewSectionReader(s.file, int64(off), int64(first))); err != nil {
+		return err
+	}
+	if first < n {
+		_, err := io.Copy(w, io.NewSectionReader(s.file, 0, int64(n-first)))
+		return err
+	}
+	return nil
+}
+
+// 只保留最新的 n 个字节，全部被确认后清空文件
+func (s *spool) trim(n int) {
+	if s == nil || s.length <= n {
+		return
+	}
+	s.length = n
+	if n == 0 && s.file != nil {
+		s.file.Truncate(0)
+		s.end = 0
+	}
+}
+
+// 关闭并删除临时文件
+func (s *spool) Close() {
+	if s != nil && s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+		s.length = 0
+	}
+}
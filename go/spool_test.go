@@ -0,0 +1,104 @@
+package snet
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Rewriter_Spool(t *testing.T) {
+	writer := newRewriter(16, 0)
+	writer.spool = newSpool(t.TempDir(), 64)
+	defer writer.release()
+	tester := &rewriterTester{&writer, t, nil}
+
+	var raw []byte
+	for i := 0; i < 100; i++ {
+		var b []byte
+		if rand.Intn(2) == 0 {
+			b = randBlock(1 + rand.Intn(20))
+			writer.Push(b)
+		} else {
+			b = randBlock(1 + rand.Intn(15))
+			first, second := writer.PushXOR(noneCipher{}, b)
+			if !bytes.Equal(append(first, second...), b) {
+				t.Fatalf("PushXOR")
+			}
+		}
+		raw = append(raw, b...)
+
+		buffered := min(len(raw), 16+64)
+		if writer.Buffered() != buffered {
+			t.Fatalf("buffered = %d, want %d", writer.Buffered(), buffered)
+		}
+		n := rand.Intn(buffered + 1)
+		tester.Match(uint64(len(raw)), uint64(len(raw)-n), raw[len(raw)-n:])
+	}
+
+	if writer.Rewrite(tester, uint64(len(raw)), uint64(len(raw)-81)) {
+		t.Fatalf("rewrite beyond spool")
+	}
+
+	writer.trim(40)
+	if writer.Buffered() != 40 {
+		t.Fatalf("buffered = %d", writer.Buffered())
+	}
+	tester.Match(uint64(len(raw)), uint64(len(raw)-40), raw[len(raw)-40:])
+
+	writer.trim(8)
+	if writer.spool.Len() != 0 || writer.Buffered() != 8 {
+		t.Fatalf("spool = %d, buffered = %d", writer.spool.Len(), writer.Buffered())
+	}
+}
+
+func Test_Spool_Reconn(t *testing.T) {
+	dir := t.TempDir()
+	srvConfig := Config{
+		EnableCrypt:        true,
+		RewriterBufferSize: 1024,
+		ReconnWaitTimeout:  time.Minute,
+	}
+	cliConfig := srvConfig
+	cliConfig.SpoolDir = dir
+	cliConfig.SpoolMaxSize = 1024 * 1024
+
+	listener, conn, sconn := testConns(t, srvConfig, cliConfig)
+	defer listener.Close()
+
+	// 写入的数据全部丢失，重连后从文件中重传
+	conn.WrapBaseForTest(func(base net.Conn) net.Conn {
+		return muteConn{base}
+	})
+	b := randBlock(256 * 1024)
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	conn.baseForTest().Close()
+	go io.Copy(io.Discard, conn)
+
+	c := make([]byte, len(b))
+	if _, err := io.ReadFull(sconn, c); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Fatalf("b != c")
+	}
+
+	// 等待重连结束
+	conn.baseForTest()
+	conn.Close()
+	for i := 0; ; i++ {
+		files, _ := os.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("spool file not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,48 @@
+package snet
+
+import (
+	"net"
+	"testing"
+)
+
+// 建立一对连接，返回 Listener、客户端和服务端的连接
+func testListen(t *testing.T, config Config) *Listener {
+	listener, err := Listen(config, func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	return listener
+}
+
+// 握手失败时返回错误，由调用者判断是否符合预期
+func testDial(listener *Listener, config Config) (*Conn, error) {
+	conn, err := Dial(config, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*Conn), nil
+}
+
+func testConns(t *testing.T, srvConfig, cliConfig Config) (*Listener, *Conn, *Conn) {
+	listener := testListen(t, srvConfig)
+	conn, err := testDial(listener, cliConfig)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+
+	sconn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+	return listener, conn, sconn.(*Conn)
+}
+
+func (c *Conn) baseForTest() net.Conn {
+	c.reconnMutex.RLock()
+	defer c.reconnMutex.RUnlock()
+	return c.base
+}